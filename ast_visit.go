@@ -0,0 +1,88 @@
+package celjsontemplates
+
+import (
+	"github.com/google/cel-go/common/ast"
+)
+
+// visitExpr calls visit for e and every expression within it, parents before children
+func visitExpr(e ast.Expr, visit func(ast.Expr)) {
+	visit(e)
+	visitChildren(e, func(child ast.Expr) {
+		visitExpr(child, visit)
+	})
+}
+
+// visitChildren calls visit for each expression directly within e
+func visitChildren(e ast.Expr, visit func(ast.Expr)) {
+	switch e.Kind() {
+	case ast.SelectKind:
+		visit(e.AsSelect().Operand())
+	case ast.CallKind:
+		call := e.AsCall()
+		if call.IsMemberFunction() {
+			visit(call.Target())
+		}
+		for _, arg := range call.Args() {
+			visit(arg)
+		}
+	case ast.ListKind:
+		for _, elem := range e.AsList().Elements() {
+			visit(elem)
+		}
+	case ast.MapKind:
+		for _, entry := range e.AsMap().Entries() {
+			visit(entry.AsMapEntry().Key())
+			visit(entry.AsMapEntry().Value())
+		}
+	case ast.StructKind:
+		for _, field := range e.AsStruct().Fields() {
+			visit(field.AsStructField().Value())
+		}
+	case ast.ComprehensionKind:
+		comp := e.AsComprehension()
+		visit(comp.IterRange())
+		visit(comp.AccuInit())
+		visit(comp.LoopCondition())
+		visit(comp.LoopStep())
+		visit(comp.Result())
+	}
+}
+
+// freeVariables returns the variables used by an expression. Comprehension variables are left out
+// within the comprehension's loop condition, loop step and result, where they are declared.
+func freeVariables(e ast.Expr) map[string]bool {
+	identifiers := make(map[string]bool)
+	collectFreeVariables(e, map[string]bool{}, identifiers)
+	return identifiers
+}
+
+func collectFreeVariables(e ast.Expr, bound map[string]bool, identifiers map[string]bool) {
+	if e.Kind() == ast.ComprehensionKind {
+		comp := e.AsComprehension()
+		collectFreeVariables(comp.IterRange(), bound, identifiers)
+		collectFreeVariables(comp.AccuInit(), bound, identifiers)
+
+		loopBound := make(map[string]bool, len(bound)+2)
+		for name := range bound {
+			loopBound[name] = true
+		}
+		loopBound[comp.IterVar()] = true
+		loopBound[comp.AccuVar()] = true
+		collectFreeVariables(comp.LoopCondition(), loopBound, identifiers)
+		collectFreeVariables(comp.LoopStep(), loopBound, identifiers)
+		collectFreeVariables(comp.Result(), loopBound, identifiers)
+		return
+	}
+
+	if e.Kind() == ast.IdentKind {
+		if !bound[e.AsIdent()] {
+			identifiers[e.AsIdent()] = true
+		}
+		return
+	}
+
+	// Visit the direct children, comprehensions within them are handled above
+	visitChildren(e, func(child ast.Expr) {
+		collectFreeVariables(child, bound, identifiers)
+	})
+}
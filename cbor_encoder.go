@@ -0,0 +1,228 @@
+package celjsontemplates
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+)
+
+// CBOR major types (RFC 8949 section 3.1)
+const (
+	cborUnsignedInt byte = 0 << 5
+	cborNegativeInt byte = 1 << 5
+	cborByteString  byte = 2 << 5
+	cborTextString  byte = 3 << 5
+	cborArray       byte = 4 << 5
+	cborMap         byte = 5 << 5
+	cborTag         byte = 6 << 5
+	cborSimple      byte = 7 << 5
+)
+
+// CborEncoder encodes the template output as CBOR (RFC 8949).
+// Bytes are written as byte strings and timestamps as epoch based date/time values (tag 1).
+// By default map keys are written in template order. Setting Deterministic applies the core
+// deterministic encoding rules of RFC 8949 section 4.2: map keys are sorted by their encoded
+// bytes and floating point values use their shortest exact form.
+type CborEncoder struct {
+	Deterministic bool
+}
+
+// Encode implements Encoder
+func (e CborEncoder) Encode(value any) ([]byte, error) {
+	nv, err := normalizeOutput(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = e.writeValue(&buf, nv)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (e CborEncoder) writeValue(buf *bytes.Buffer, value any) error {
+	switch val := value.(type) {
+	case nil:
+		buf.WriteByte(cborSimple | 22)
+	case bool:
+		if val {
+			buf.WriteByte(cborSimple | 21)
+		} else {
+			buf.WriteByte(cborSimple | 20)
+		}
+	case int64:
+		writeCborInt(buf, val)
+	case uint64:
+		writeCborHead(buf, cborUnsignedInt, val)
+	case float64:
+		e.writeFloat(buf, val)
+	case string:
+		writeCborHead(buf, cborTextString, uint64(len(val)))
+		buf.WriteString(val)
+	case []byte:
+		writeCborHead(buf, cborByteString, uint64(len(val)))
+		buf.Write(val)
+	case time.Time:
+		// Tag 1 - epoch based date/time
+		writeCborHead(buf, cborTag, 1)
+		if val.Nanosecond() == 0 {
+			writeCborInt(buf, val.Unix())
+		} else {
+			e.writeFloat(buf, float64(val.UnixNano())/1e9)
+		}
+	case time.Duration:
+		writeCborInt(buf, int64(val))
+	case []any:
+		writeCborHead(buf, cborArray, uint64(len(val)))
+		for _, item := range val {
+			err := e.writeValue(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+	case *orderedmap.OrderedMap[string, any]:
+		return e.writeMap(buf, val)
+	default:
+		return fmt.Errorf("cbor: unsupported type %T", value)
+	}
+	return nil
+}
+
+func (e CborEncoder) writeMap(buf *bytes.Buffer, m *orderedmap.OrderedMap[string, any]) error {
+	writeCborHead(buf, cborMap, uint64(m.Len()))
+
+	if !e.Deterministic {
+		for pair := m.Oldest(); pair != nil; pair = pair.Next() {
+			writeCborHead(buf, cborTextString, uint64(len(pair.Key)))
+			buf.WriteString(pair.Key)
+			err := e.writeValue(buf, pair.Value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Deterministic encoding sorts the keys by their encoded form
+	type encodedPair struct {
+		key   []byte
+		value any
+	}
+	pairs := make([]encodedPair, 0, m.Len())
+	for pair := m.Oldest(); pair != nil; pair = pair.Next() {
+		var keyBuf bytes.Buffer
+		writeCborHead(&keyBuf, cborTextString, uint64(len(pair.Key)))
+		keyBuf.WriteString(pair.Key)
+		pairs = append(pairs, encodedPair{key: keyBuf.Bytes(), value: pair.Value})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return bytes.Compare(pairs[i].key, pairs[j].key) < 0
+	})
+	for _, pair := range pairs {
+		buf.Write(pair.key)
+		err := e.writeValue(buf, pair.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e CborEncoder) writeFloat(buf *bytes.Buffer, val float64) {
+	if e.Deterministic {
+		// Use the shortest representation that preserves the value
+		if f16, ok := float64ToFloat16(val); ok {
+			buf.WriteByte(cborSimple | 25)
+			binary.Write(buf, binary.BigEndian, f16)
+			return
+		}
+		if f32 := float32(val); float64(f32) == val || math.IsNaN(val) {
+			buf.WriteByte(cborSimple | 26)
+			binary.Write(buf, binary.BigEndian, math.Float32bits(f32))
+			return
+		}
+	}
+	buf.WriteByte(cborSimple | 27)
+	binary.Write(buf, binary.BigEndian, math.Float64bits(val))
+}
+
+// writeCborInt writes a signed integer using major type 0 or 1
+func writeCborInt(buf *bytes.Buffer, val int64) {
+	if val < 0 {
+		writeCborHead(buf, cborNegativeInt, uint64(-1-val))
+	} else {
+		writeCborHead(buf, cborUnsignedInt, uint64(val))
+	}
+}
+
+// writeCborHead writes the initial byte and argument of a data item using the shortest form
+func writeCborHead(buf *bytes.Buffer, major byte, arg uint64) {
+	switch {
+	case arg < 24:
+		buf.WriteByte(major | byte(arg))
+	case arg <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(arg))
+	case arg <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(arg))
+	case arg <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(arg))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, arg)
+	}
+}
+
+// float64ToFloat16 returns the IEEE 754 half precision bits for val if the conversion is exact
+func float64ToFloat16(val float64) (uint16, bool) {
+	if math.IsNaN(val) {
+		// Canonical NaN
+		return 0x7e00, true
+	}
+	if math.IsInf(val, 1) {
+		return 0x7c00, true
+	}
+	if math.IsInf(val, -1) {
+		return 0xfc00, true
+	}
+
+	f32 := float32(val)
+	if float64(f32) != val {
+		return 0, false
+	}
+	bits := math.Float32bits(f32)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int((bits>>23)&0xff) - 127
+	mant := bits & 0x7fffff
+
+	if val == 0 {
+		return sign, true
+	}
+
+	switch {
+	case exp >= -14 && exp <= 15:
+		// Normal half precision number - the low 13 bits of the mantissa must be zero
+		if mant&0x1fff != 0 {
+			return 0, false
+		}
+		return sign | uint16(exp+15)<<10 | uint16(mant>>13), true
+	case exp >= -24 && exp < -14:
+		// Subnormal half precision number
+		full := mant | 0x800000
+		shift := uint(-exp - 14 + 13)
+		if full&((1<<shift)-1) != 0 {
+			return 0, false
+		}
+		return sign | uint16(full>>shift), true
+	}
+	return 0, false
+}
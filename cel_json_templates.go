@@ -1,14 +1,16 @@
 package celjsontemplates
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/buger/jsonparser"
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/common/types"
 	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
 	orderedmap "github.com/wk8/go-ordered-map/v2"
 )
 
@@ -19,6 +21,17 @@ var removeAttributeFromOutput = errors.New("remove attribute")
 type Template interface {
 	// Expand runs the CEL expressions in the template against the provided data and returns the result
 	Expand(data map[string]interface{}) ([]byte, error)
+	// ExpandWithReport expands the template like Expand, also returning any warnings raised by the template
+	ExpandWithReport(data map[string]interface{}) ([]byte, []Warning, error)
+	// OutputSchema returns a JSON Schema (draft 2020-12) describing the output of the template
+	OutputSchema() ([]byte, error)
+	// References returns the data and ref fields used by the template and its fragments, with where they are used
+	References() []Reference
+	// Lineage returns the input fields that each output field depends on
+	Lineage() Lineage
+	// Specialize evaluates as much of the template as possible with part of the data, returning a
+	// template that only has to evaluate what depends on the rest of the data
+	Specialize(partialData map[string]interface{}) (Template, error)
 }
 
 // The structure that implements Template
@@ -34,32 +47,50 @@ type celTemplate struct {
 	// fragments holds the list of fragments that are available to this template
 	fragments map[string]string
 	// compiledFragments holds the CEL compiled fragments
-	compiledFragments map[string]*orderedmap.OrderedMap[string, interface{}]
+	compiledFragments map[string]*compiledFragment
+	// encoder converts the expanded output into bytes
+	encoder Encoder
+	// maxFragmentDepth limits how deeply fragments can call other fragments
+	maxFragmentDepth int
+	// dataSchemaJson holds the JSON Schema describing the input data, if one was given
+	dataSchemaJson []byte
+	// dataSchema holds the CEL types converted from dataSchemaJson
+	dataSchema *schemaNode
+	// typeProvider holds the struct types declared for data and ref, if any
+	typeProvider *structTypeProvider
+	// typedRef flag controls whether the type of ref is inferred from the reference data
+	typedRef bool
+	// optionalTypes flag controls whether CEL optional types are available
+	optionalTypes bool
+	// pruneEmpty flag controls whether objects and lists left empty after expansion are removed
+	pruneEmpty bool
+	// partialData holds the data given to Specialize, which is added to the data passed to Expand
+	partialData map[string]any
+	// requirements holds the $require preconditions on the input data
+	requirements []*requirement
+	// outputSchemaJson holds the JSON Schema that the output is checked against, if one was given
+	outputSchemaJson []byte
+	// outputSchema checks the output against outputSchemaJson
+	outputSchema *outputValidator
+	// memoizeExpressions flag controls whether expressions that only read data and ref are run once per expansion
+	memoizeExpressions bool
+	// noConstantFolding flag stops expressions that only depend on ref being evaluated by New
+	noConstantFolding bool
+	// outputReferences flag controls whether expressions can use self and root to refer to earlier output
+	outputReferences bool
 }
 
 func (t *celTemplate) Expand(data map[string]interface{}) ([]byte, error) {
-	input := map[string]interface{}{
-		"data": data,
-	}
-
-	if t.ref != nil {
-		input["ref"] = t.ref
-	}
-
-	outputData, err := t.expandNode(input, t.compiledTemplate)
-
-	if err != nil {
-		return nil, err
-	}
-
-	// Encode as JSON
-	jdata, err := json.Marshal(outputData)
+	encoded, _, err := t.expand(data)
+	return encoded, err
+}
 
+func (t *celTemplate) ExpandWithReport(data map[string]interface{}) ([]byte, []Warning, error) {
+	encoded, ex, err := t.expand(data)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	return jdata, nil
+	return encoded, ex.warnings, nil
 }
 
 // ExpandJsonData will be used in the future to allow direct expansion of data
@@ -68,250 +99,246 @@ func (t *celTemplate) ExpandJsonData(data string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	//fmt.Printf("data object: %v\n", inputJsonAsData)
 
+	encoded, _, err := t.expand(inputJsonAsData)
+	return encoded, err
+}
+
+// expand runs the template against data and encodes the output, returning the expansion state
+// so that callers can report on it.
+func (t *celTemplate) expand(data any) ([]byte, *expansion, error) {
+	data = mergeData(t.partialData, data)
+	if t.dataSchema != nil {
+		data = t.dataSchema.coerce(data)
+	}
+
+	ex := newExpansion(data)
+	ex.fragments = t.compiledFragments
+	if t.memoizeExpressions {
+		ex.memo = make(map[string]memoResult)
+	}
+	if t.outputSchema != nil {
+		ex.sources = map[string]string{"": "#"}
+	}
 	input := map[string]interface{}{
-		"data": inputJsonAsData,
+		"data":            data,
+		expansionVariable: ex,
 	}
 
 	if t.ref != nil {
 		input["ref"] = t.ref
-		// input.m.Set("ref", t.ref)
 	}
 
-	outputData, err := t.expandNode(input, t.compiledTemplate)
+	// root is the top level output, even for fragments called by the preconditions
+	ex.root = orderedmap.New[string, interface{}]()
 
+	err := t.checkRequirements(input)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Encode as JSON
-	jdata, err := json.Marshal(outputData)
+	outputData, err := t.expandObject(input, t.compiledTemplate, ex.root)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return jdata, nil
+	if t.outputSchema != nil {
+		err = t.outputSchema.check(outputData, ex)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Encode the output
+	encoded, err := t.encoder.Encode(outputData)
 
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encoded, ex, nil
 }
 
-func (t *celTemplate) expandNode(input map[string]any, node *orderedmap.OrderedMap[string, interface{}]) (*orderedmap.OrderedMap[string, interface{}], error) {
-	// Our output data
-	outputData := orderedmap.New[string, interface{}]()
+// checkEvalError decides how an error from evaluating a template expression is handled.
+// A nil result means the error is suppressed and the attribute removed from the output, otherwise
+// the returned error stops the expansion.
+func (t *celTemplate) checkEvalError(err error, missingKeys missingKeyMode) error {
+	// Templates can stop the expansion themselves
+	var failure *TemplateFailure
+	if errors.As(err, &failure) {
+		return failure
+	}
 
-	for pair := node.Oldest(); pair != nil; pair = pair.Next() {
-		switch val := pair.Value.(type) {
-		case cel.Program:
-			// Run the program
-			out, _, err := val.Eval(input)
-			if err != nil {
-				// This is a signal to remove the attribute
-				if err.Error() == removeAttributeFromOutput.Error() {
-					continue
-				}
-				// If there's a key missing we normally just continue
-				if !(strings.Contains(err.Error(), "no such key") && t.errorOnMissingKeys) {
-					continue
+	// Problems calling fragments are always reported
+	var fragmentErr *FragmentError
+	if errors.As(err, &fragmentErr) {
+		return err
+	}
 
-				} else {
-					return nil, err
-				}
-			}
+	// This is a signal to remove the attribute
+	if err.Error() == removeAttributeFromOutput.Error() {
+		return nil
+	}
 
-			outputData.Set(pair.Key, out.Value())
-		case *orderedmap.OrderedMap[string, interface{}]:
-			// Sub object - expand it
-			subOutput, err := t.expandNode(input, val)
-			if err != nil {
-				return outputData, err
+	// If there's a key missing we normally just continue
+	if strings.Contains(err.Error(), "no such key") {
+		switch missingKeys {
+		case missingKeysRequired:
+			return err
+		case missingKeysDefault:
+			if t.errorOnMissingKeys {
+				return err
 			}
+		}
+	}
 
-			outputData.Set(pair.Key, subOutput)
-		case []interface{}:
-			// Expand the node list
-			listOutput, err := t.expandNodeList(input, val)
-			if err != nil {
-				return outputData, err
-			}
+	return nil
+}
 
-			outputData.Set(pair.Key, listOutput)
-		default:
-			outputData.Set(pair.Key, pair.Value)
+// outputValue converts the result of a template expression into a value for the output tree.
+// Values from the input data are passed through unchanged, while lists and maps built by CEL (for
+// example by the map and filter macros) are converted so that fragment results within them keep
+// their content and key order.
+func outputValue(val ref.Val) interface{} {
+	switch v := val.(type) {
+	case types.Null:
+		return nil
+	case *orderedCelMap:
+		return v.m
+	case traits.Lister:
+		items, ok := v.Value().([]ref.Val)
+		if !ok {
+			break
+		}
+		result := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			result = append(result, outputValue(item))
 		}
+		return result
+	case traits.Mapper:
+		entries, ok := v.Value().(map[ref.Val]ref.Val)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(entries))
+		values := make(map[string]ref.Val, len(entries))
+		for key, value := range entries {
+			keyStr := fmt.Sprint(key.Value())
+			keys = append(keys, keyStr)
+			values[keyStr] = value
+		}
+		sort.Strings(keys)
+		result := orderedmap.New[string, interface{}]()
+		for _, key := range keys {
+			result.Set(key, outputValue(values[key]))
+		}
+		return result
 	}
-	return outputData, nil
+	return val.Value()
 }
 
-func (t *celTemplate) expandNodeList(input map[string]interface{}, nodeList []interface{}) ([]interface{}, error) {
-	// Our output data
-	var outputList []interface{} = make([]interface{}, 0)
-
-	for _, value := range nodeList {
-		switch val := value.(type) {
-		case cel.Program:
-			// Run the program
-			out, _, err := val.Eval(input)
-			if err != nil {
-				if err.Error() == removeAttributeFromOutput.Error() {
-					// Signal is to remove this item from the list
-					continue
-				}
-				if !(strings.Contains(err.Error(), "no such key") && t.errorOnMissingKeys) {
-					continue
-
-				} else {
-					return nil, err
-				}
+func (t *celTemplate) expandNode(input map[string]any, node *orderedmap.OrderedMap[string, interface{}]) (*orderedmap.OrderedMap[string, interface{}], error) {
+	return t.expandObject(input, node, orderedmap.New[string, interface{}]())
+}
 
-			}
+// expandObject expands the keys of node into outputData
+func (t *celTemplate) expandObject(input map[string]any, node *orderedmap.OrderedMap[string, interface{}], outputData *orderedmap.OrderedMap[string, interface{}]) (*orderedmap.OrderedMap[string, interface{}], error) {
+	ex := input[expansionVariable].(*expansion)
 
-			outputList = append(outputList, out.Value())
-		case *orderedmap.OrderedMap[string, interface{}]:
-			// Sub object - expand it
-			subOutput, err := t.expandNode(input, val)
-			if err != nil {
-				return outputList, err
-			}
-			outputList = append(outputList, subOutput)
+	if t.outputReferences {
+		input = bindOutputReferences(input, outputData)
+	}
 
-		case []interface{}:
-			// Expand the node list
-			listOutput, err := t.expandNodeList(input, val)
+	for pair := node.Oldest(); pair != nil; pair = pair.Next() {
+		if lets, ok := pair.Value.(*letBindings); ok {
+			// Variables for the rest of this object
+			var err error
+			input, err = t.bindLets(input, lets)
 			if err != nil {
-				return listOutput, err
+				return nil, err
 			}
-
-			outputList = append(outputList, listOutput)
-
-		default:
-			outputList = append(outputList, val)
-		}
-	}
-	return outputList, nil
-}
-
-func (t *celTemplate) getFragmentsFunction() cel.EnvOption {
-	ourBinding := cel.FunctionBinding(func(args ...ref.Val) ref.Val {
-		// Search for the fragment name in the first argument, add additional arguments to the env then execute.
-		if len(args) == 0 {
-			return types.WrapErr(errors.New("fragment takes at least one argument - the name of the fragment to use"))
-		}
-
-		ct, ok := t.compiledFragments[args[0].Value().(string)]
-		if !ok {
-			return types.WrapErr(errors.New("fragment not found"))
+			continue
 		}
 
-		var passedArgs []interface{}
-		for _, ourArg := range args[1:] {
-			passedArgs = append(passedArgs, ourArg.Value())
+		ex.pushKey(pair.Key)
+		ex.pushTemplateKey(templateKey(pair.Key, pair.Value))
+		ex.recordSource()
+		value, keep, err := t.expandValue(input, pair.Value)
+		ex.popTemplatePath()
+		ex.popPath()
+		if err != nil {
+			return nil, err
 		}
 
-		input := map[string]interface{}{
-			"args": passedArgs,
+		// Most errors just remove the attribute
+		if keep {
+			outputData.Set(pair.Key, value)
 		}
+	}
+	return outputData, nil
+}
 
-		if t.ref != nil {
-			input["ref"] = t.ref
-		}
+func (t *celTemplate) expandNodeList(input map[string]interface{}, nodeList []interface{}) ([]interface{}, error) {
+	ex := input[expansionVariable].(*expansion)
 
-		outputData, err := t.expandNode(input, ct)
+	// Our output data
+	var outputList []interface{} = make([]interface{}, 0)
 
+	for i, node := range nodeList {
+		ex.pushIndex(len(outputList))
+		ex.pushTemplateIndex(i)
+		ex.recordSource()
+		value, keep, err := t.expandValue(input, node)
+		ex.popTemplatePath()
+		ex.popPath()
 		if err != nil {
-			types.WrapErr(err)
-		}
-
-		return wrapOrderedCelMap(outputData)
-		// return types.DefaultTypeAdapter.NativeToValue(outputData)
-		// return orderedCelMapCustomTypeAdapter{}.NativeToValue(outputData)
-
-	})
-
-	listBasedBinding := cel.FunctionBinding(func(args ...ref.Val) ref.Val {
-		// Search for the fragment name in the first argument, add additional arguments to the env then execute.
-		if len(args) < 2 {
-			return types.WrapErr(errors.New("fragment takes at least one argument - the name of the fragment to use"))
+			return nil, err
 		}
 
-		ct, ok := t.compiledFragments[args[1].Value().(string)]
-		if !ok {
-			return types.WrapErr(errors.New("fragment not found"))
+		// Most errors just remove this item from the list
+		if keep {
+			outputList = append(outputList, value)
 		}
+	}
+	return outputList, nil
+}
 
-		var passedArgs []interface{}
-		// Placeholder in position 0 of the passed args - will be the item
-		passedArgs = append(passedArgs, nil)
-		for _, ourArg := range args[2:] {
-			passedArgs = append(passedArgs, ourArg.Value())
+// expandValue expands a single value from the compiled template.
+// It reports false if the value should be left out of the output.
+func (t *celTemplate) expandValue(input map[string]any, node any) (any, bool, error) {
+	switch val := node.(type) {
+	case *templateExpression:
+		// Run the program
+		out, err := val.eval(input)
+		if err != nil {
+			return nil, false, t.checkEvalError(err, val.missingKeys)
 		}
 
-		input := map[string]interface{}{
-			"args": passedArgs,
+		// An empty optional leaves the value out, otherwise the optional's value is used
+		if opt, ok := out.(*types.Optional); ok {
+			if !opt.HasValue() {
+				return nil, false, nil
+			}
+			out = opt.GetValue()
 		}
-
-		if t.ref != nil {
-			input["ref"] = t.ref
+		return outputValue(out), true, nil
+	case *orderedmap.OrderedMap[string, interface{}]:
+		// Sub object - expand it
+		subOutput, err := t.expandNode(input, val)
+		if err != nil {
+			return nil, false, err
 		}
-
-		var resultList []interface{}
-		for _, value := range args[0].Value().([]interface{}) {
-			passedArgs[0] = value
-			outputData, err := t.expandNode(input, ct)
-
-			if err != nil {
-				types.WrapErr(err)
-			}
-
-			resultList = append(resultList, outputData)
-
-			// resultList = append(resultList, WrapOrderedCelMap(outputData))
+		return subOutput, !t.pruneEmpty || subOutput.Len() > 0, nil
+	case []interface{}:
+		// Expand the node list
+		listOutput, err := t.expandNodeList(input, val)
+		if err != nil {
+			return nil, false, err
 		}
-
-		return orderedCelMapAdapter.NativeToValue(resultList)
-		// return types.DefaultTypeAdapter.NativeToValue(resultList)
-
-	})
-
-	return cel.Function("fragment",
-		cel.Overload("fragment_string_dyn", []*cel.Type{cel.StringType}, cel.DynType,
-			ourBinding,
-		),
-		cel.Overload("fragment_string_dyn_dyn", []*cel.Type{cel.StringType, cel.DynType}, cel.DynType,
-			ourBinding,
-		),
-		cel.Overload("fragment_string_dyn_dyn_dyn", []*cel.Type{cel.StringType, cel.DynType, cel.DynType}, cel.DynType,
-			ourBinding,
-		),
-		cel.Overload("fragment_string_dyn_dyn_dyn_dyn", []*cel.Type{cel.StringType, cel.DynType, cel.DynType, cel.DynType}, cel.DynType,
-			ourBinding,
-		),
-		cel.Overload("fragment_string_dyn_dyn_dyn_dyn_dyn", []*cel.Type{cel.StringType, cel.DynType, cel.DynType, cel.DynType, cel.DynType}, cel.DynType,
-			ourBinding,
-		),
-		cel.Overload("fragment_string_dyn_dyn_dyn_dyn_dyn_dyn", []*cel.Type{cel.StringType, cel.DynType, cel.DynType, cel.DynType, cel.DynType, cel.DynType}, cel.DynType,
-			ourBinding,
-		),
-		// Now the list based overloads
-		cel.MemberOverload("dyn_fragment_string_dyn", []*cel.Type{cel.DynType, cel.StringType}, cel.DynType,
-			listBasedBinding,
-		),
-		cel.MemberOverload("dyn_fragment_string_dyn_dyn", []*cel.Type{cel.DynType, cel.StringType, cel.DynType}, cel.DynType,
-			listBasedBinding,
-		),
-		cel.MemberOverload("dyn_fragment_string_dyn_dyn_dyn", []*cel.Type{cel.DynType, cel.StringType, cel.DynType, cel.DynType}, cel.DynType,
-			listBasedBinding,
-		),
-		cel.MemberOverload("dyn_fragment_string_dyn_dyn_dyn_dyn", []*cel.Type{cel.DynType, cel.StringType, cel.DynType, cel.DynType, cel.DynType}, cel.DynType,
-			listBasedBinding,
-		),
-		cel.MemberOverload("dyn_fragment_string_dyn_dyn_dyn_dyn_dyn", []*cel.Type{cel.DynType, cel.StringType, cel.DynType, cel.DynType, cel.DynType, cel.DynType}, cel.DynType,
-			listBasedBinding,
-		),
-		cel.MemberOverload("dyn_fragment_string_dyn_dyn_dyn_dyn_dyn_dyn", []*cel.Type{cel.DynType, cel.StringType, cel.DynType, cel.DynType, cel.DynType, cel.DynType, cel.DynType}, cel.DynType,
-			listBasedBinding,
-		),
-	)
+		return listOutput, !t.pruneEmpty || len(listOutput) > 0, nil
+	}
+	return node, true, nil
 }
 
 // WithXXX functions provide configuration options by returning TemplateConfigFunc
@@ -327,6 +354,16 @@ func WithRef(ref map[string]interface{}) TemplateConfigFunc {
 	}
 }
 
+// WithTypedRef declares the type of ref using the reference data passed to WithRef, so that unknown
+// names and type mismatches are reported when the template is compiled. The top level of the
+// reference data is treated as a struct, as are nested maps with values of different types. Nested
+// maps whose values all have the same type, such as lookup tables, are treated as maps.
+func WithTypedRef() TemplateConfigFunc {
+	return func(t *celTemplate) {
+		t.typedRef = true
+	}
+}
+
 // WithMissingKeyErrors will trigger errors when a template CEL expression refers to a missing key.
 // By default such errors are suppressed
 func WithMissingKeyErrors() TemplateConfigFunc {
@@ -350,36 +387,168 @@ func WithFragments(templates map[string]string) TemplateConfigFunc {
 	}
 }
 
+// WithEncoder sets the Encoder used to produce the output of Expand.
+// By default the output is encoded as JSON.
+func WithEncoder(encoder Encoder) TemplateConfigFunc {
+	return func(t *celTemplate) {
+		t.encoder = encoder
+	}
+}
+
+// WithMaxFragmentDepth limits how deeply fragments can call other fragments (including themselves).
+// Expansion stops with a FragmentError wrapping ErrFragmentDepthExceeded when the limit is reached.
+// The default limit is 32.
+func WithMaxFragmentDepth(depth int) TemplateConfigFunc {
+	return func(t *celTemplate) {
+		t.maxFragmentDepth = depth
+	}
+}
+
+// WithDataSchema declares the type of the input data using a JSON Schema, so that mistakes such as
+// unknown fields and type mismatches are reported when the template is compiled. Objects that list
+// their properties and leave additionalProperties unset or false are checked field by field. When the
+// template is expanded numbers in the data are converted to the integer or number types in the schema.
+func WithDataSchema(jsonSchema []byte) TemplateConfigFunc {
+	return func(t *celTemplate) {
+		t.dataSchemaJson = jsonSchema
+	}
+}
+
+// WithOutputSchema checks the output of every expansion against a JSON Schema. Output that doesn't
+// match is reported by an OutputSchemaError listing each problem with its location in the output and,
+// where it is known, in the template. Only local references (such as #/$defs/item) are supported.
+func WithOutputSchema(jsonSchema []byte) TemplateConfigFunc {
+	return func(t *celTemplate) {
+		t.outputSchemaJson = jsonSchema
+	}
+}
+
+// WithoutConstantFolding stops New from evaluating the expressions that only use literals and ref,
+// such as "ref.categories['u']". By default these are evaluated once, rather than on every expansion,
+// so this option is needed if the contents of the reference data are changed after New.
+func WithoutConstantFolding() TemplateConfigFunc {
+	return func(t *celTemplate) {
+		t.noConstantFolding = true
+	}
+}
+
+// WithExpressionMemoization runs each distinct expression that only reads data and ref once per
+// expansion, reusing the result wherever the expression is repeated in the template or in a fragment.
+// This helps large templates that repeat the same expressions, such as fragments called for every item of a list.
+func WithExpressionMemoization() TemplateConfigFunc {
+	return func(t *celTemplate) {
+		t.memoizeExpressions = true
+	}
+}
+
+// WithOptionalTypes enables CEL optional types, such as data.?address.?city.orValue('unknown').
+// An expression that evaluates to optional.none() is left out of the output and optional.of(x) outputs x.
+func WithOptionalTypes() TemplateConfigFunc {
+	return func(t *celTemplate) {
+		t.optionalTypes = true
+	}
+}
+
+// WithPruneEmpty removes objects and lists in the template that are empty once expanded, for
+// example because all of their properties were removed. The top level object is always output.
+func WithPruneEmpty() TemplateConfigFunc {
+	return func(t *celTemplate) {
+		t.pruneEmpty = true
+	}
+}
+
+// WithOutputReferences makes the output computed so far available to later expressions.
+// self holds the earlier keys of the object being expanded and root the earlier top level keys.
+// Expressions can only select keys that come before them, which is checked when the template is compiled.
+func WithOutputReferences() TemplateConfigFunc {
+	return func(t *celTemplate) {
+		t.outputReferences = true
+	}
+}
+
 // Creates a new Template using the provided input and options
 func New(template string, config ...TemplateConfigFunc) (Template, error) {
 	t := &celTemplate{
 		ref:               make(map[string]interface{}),
 		fragments:         make(map[string]string),
-		compiledFragments: make(map[string]*orderedmap.OrderedMap[string, interface{}]),
+		compiledFragments: make(map[string]*compiledFragment),
+		encoder:           JsonEncoder{},
+		maxFragmentDepth:  defaultMaxFragmentDepth,
 	}
 	for _, cfg := range config {
 		cfg(t)
 	}
 
+	if t.outputSchemaJson != nil {
+		var err error
+		t.outputSchema, err = parseOutputSchema(t.outputSchemaJson)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The types of the data and reference data
+	var typeOptions []cel.EnvOption
+	dataType := cel.MapType(cel.StringType, cel.DynType)
+	refType := cel.MapType(cel.StringType, cel.DynType)
+	if t.dataSchemaJson != nil || t.typedRef {
+		provider, err := newStructTypeProvider()
+		if err != nil {
+			return nil, err
+		}
+		t.typeProvider = provider
+		if t.dataSchemaJson != nil {
+			t.dataSchema, err = parseDataSchema(t.dataSchemaJson, provider)
+			if err != nil {
+				return nil, err
+			}
+			dataType = t.dataSchema.celType
+		}
+		if t.typedRef {
+			refType = inferRefType(t.ref, provider)
+		}
+		// The provider comes first so that types registered by other options are kept
+		typeOptions = append(typeOptions, cel.CustomTypeProvider(provider))
+	}
+
 	// Build the CEL compilation environment.
 	var templateOptions []cel.EnvOption
+	templateOptions = append(templateOptions, typeOptions...)
 	templateOptions = append(templateOptions, t.celOptions...)
 
-	templateOptions = append(templateOptions, cel.Variable("ref", cel.MapType(cel.StringType, cel.DynType)))
-	templateOptions = append(templateOptions, cel.Variable("data", cel.MapType(cel.StringType, cel.DynType)))
+	templateOptions = append(templateOptions, cel.Variable("ref", refType))
+	templateOptions = append(templateOptions, cel.Variable("data", dataType))
+	templateOptions = append(templateOptions, cel.Variable(expansionVariable, expansionType))
 	templateOptions = append(templateOptions, getRemoveFunction())
+	templateOptions = append(templateOptions, getOmitFunctions()...)
+	templateOptions = append(templateOptions, getFailFunctions()...)
+	templateOptions = append(templateOptions, getWarnFunction()...)
 	templateOptions = append(templateOptions, t.getFragmentsFunction())
+	templateOptions = append(templateOptions, getFragmentMacros())
 	templateOptions = append(templateOptions, cel.CustomTypeAdapter(orderedCelMapCustomTypeAdapter{}))
-	templateOptions = append(templateOptions, cel.Types(orderedCelMapType))
+	if t.optionalTypes {
+		templateOptions = append(templateOptions, cel.OptionalTypes())
+	}
+	if t.outputReferences {
+		templateOptions = append(templateOptions, cel.Variable(selfVariable, cel.MapType(cel.StringType, cel.DynType)))
+		templateOptions = append(templateOptions, cel.Variable(rootVariable, cel.MapType(cel.StringType, cel.DynType)))
+	}
 
-	env, err := cel.NewEnv(templateOptions...)
+	env, err := newTemplateEnv(templateOptions...)
 
 	if err != nil {
 		return nil, err
 	}
 
-	// Parse the template from JSON
-	t.compiledTemplate, err = parseTemplate(env, []byte(template))
+	// The preconditions are checked before the rest of the template is expanded
+	t.requirements, err = parseRequirements(env, []byte(template), newOutputScope(t.outputReferences))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the template from JSON, the $require block isn't part of the output
+	t.compiledTemplate, err = parseTemplate(env, jsonparser.Delete([]byte(template), requireKey), newOutputScope(t.outputReferences))
 
 	if err != nil {
 		return nil, err
@@ -387,23 +556,41 @@ func New(template string, config ...TemplateConfigFunc) (Template, error) {
 
 	// Compile any fragments now
 	var fragmentOptions []cel.EnvOption
+	fragmentOptions = append(fragmentOptions, typeOptions...)
 	fragmentOptions = append(fragmentOptions, t.celOptions...)
 
-	fragmentOptions = append(fragmentOptions, cel.Variable("ref", cel.MapType(cel.StringType, cel.DynType)))
+	fragmentOptions = append(fragmentOptions, cel.Variable("ref", refType))
+	fragmentOptions = append(fragmentOptions, cel.Variable("data", dataType))
 	fragmentOptions = append(fragmentOptions, cel.Variable("args", cel.ListType(cel.DynType)))
+	fragmentOptions = append(fragmentOptions, cel.Variable("parent", cel.MapType(cel.StringType, cel.DynType)))
+	fragmentOptions = append(fragmentOptions, cel.Variable("index", cel.IntType))
+	fragmentOptions = append(fragmentOptions, cel.Variable("first", cel.BoolType))
+	fragmentOptions = append(fragmentOptions, cel.Variable("last", cel.BoolType))
+	fragmentOptions = append(fragmentOptions, cel.Variable("length", cel.IntType))
+	fragmentOptions = append(fragmentOptions, cel.Variable(expansionVariable, expansionType))
 	fragmentOptions = append(fragmentOptions, getRemoveFunction())
+	fragmentOptions = append(fragmentOptions, getOmitFunctions()...)
+	fragmentOptions = append(fragmentOptions, getFailFunctions()...)
+	fragmentOptions = append(fragmentOptions, getWarnFunction()...)
+	fragmentOptions = append(fragmentOptions, t.getFragmentsFunction())
+	fragmentOptions = append(fragmentOptions, getFragmentMacros())
 	fragmentOptions = append(fragmentOptions, cel.CustomTypeAdapter(orderedCelMapCustomTypeAdapter{}))
-	fragmentOptions = append(fragmentOptions, cel.Types(orderedCelMapType))
+	if t.optionalTypes {
+		fragmentOptions = append(fragmentOptions, cel.OptionalTypes())
+	}
+	if t.outputReferences {
+		// Fragments don't know where they are called from, so only self is available
+		fragmentOptions = append(fragmentOptions, cel.Variable(selfVariable, cel.MapType(cel.StringType, cel.DynType)))
+	}
 
-	fragEnv, err := cel.NewEnv(fragmentOptions...)
+	fragEnv, err := env.sibling(fragmentOptions...)
 
 	if err != nil {
 		return nil, err
 	}
 
 	for name, fragment := range t.fragments {
-		// Parse the template from JSON
-		compiledFragment, err := parseTemplate(fragEnv, []byte(fragment))
+		compiledFragment, err := compileFragment(fragEnv, name, []byte(fragment), newOutputScope(t.outputReferences))
 
 		if err != nil {
 			return nil, err
@@ -412,63 +599,97 @@ func New(template string, config ...TemplateConfigFunc) (Template, error) {
 		t.compiledFragments[name] = compiledFragment
 	}
 
+	if !t.noConstantFolding {
+		t.foldConstants()
+	}
+
 	return t, nil
 }
 
-func parseTemplate(env *cel.Env, jsonTemplate []byte) (*orderedmap.OrderedMap[string, any], error) {
-	return parseJsonObject(env, jsonTemplate)
+func parseTemplate(env *templateEnv, jsonTemplate []byte, scope *outputScope) (*orderedmap.OrderedMap[string, any], error) {
+	return parseJsonObject(env, jsonTemplate, scope)
 }
 
-func parseJsonObject(env *cel.Env, jObj []byte) (*orderedmap.OrderedMap[string, any], error) {
+func parseJsonObject(env *templateEnv, jObj []byte, scope *outputScope) (*orderedmap.OrderedMap[string, any], error) {
 	objectData := orderedmap.New[string, any]()
 
-	err := jsonparser.ObjectEach(jObj,
+	// Any $let variables are declared first so the rest of the object can use them
+	letData, letType, _, err := jsonparser.Get(jObj, letKey)
+	if err == nil {
+		if letType != jsonparser.Object {
+			return nil, fmt.Errorf("%s must be an object of variable names and expressions", letKey)
+		}
+		var lets *letBindings
+		lets, env, err = parseLetBindings(env, letData, scope)
+		if err != nil {
+			return nil, err
+		}
+		objectData.Set(letKey, lets)
+	}
+
+	err = jsonparser.ObjectEach(jObj,
 		func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
 			// fmt.Printf("Key: '%s'\n Value: '%s'\n Type: %s\n", string(key), string(value), dataType)
+			if string(key) == letKey {
+				return nil
+			}
+			// The top level $require block is removed before the template is parsed
+			if string(key) == requireKey {
+				return fmt.Errorf("%s is only allowed at the top level of the template", requireKey)
+			}
+
+			// Optional and required markers are removed from the output key
+			name, missingKeys := parseKey(string(key))
+			if missingKeys != missingKeysDefault && name == "" {
+				return fmt.Errorf("key %s: a marker must follow the name of the key", key)
+			}
+			if missingKeys != missingKeysDefault && dataType != jsonparser.String {
+				return fmt.Errorf("key %s: optional and required markers can only be used with expressions", key)
+			}
+
 			switch dataType {
 			case jsonparser.Object:
-				objVal, err := parseJsonObject(env, value)
+				objVal, err := parseJsonObject(env, value, scope.child())
 				if err != nil {
 					return err
 				}
-				objectData.Set(string(key), objVal)
+				objectData.Set(name, objVal)
 			case jsonparser.String:
 				// We can attempt compilation
-				ast, issues := env.Compile(string(value))
-				if issues != nil && issues.Err() != nil {
-					return issues.Err()
-
+				expr, err := compileExpression(env, string(value), missingKeys)
+				if err != nil {
+					return err
 				}
 
-				prg, err := env.Program(ast)
-				if err != nil {
+				if err := scope.check(expr.ast); err != nil {
 					return err
 				}
 
-				objectData.Set(string(key), prg)
+				objectData.Set(name, expr)
 			case jsonparser.Boolean:
 				bval, err := jsonparser.ParseBoolean(value)
 				if err != nil {
 					return err
 				}
-				objectData.Set(string(key), bval)
+				objectData.Set(name, bval)
 			case jsonparser.Number:
 				bval, err := jsonparser.ParseFloat(value)
 				if err != nil {
 					return err
 				}
-				objectData.Set(string(key), bval)
+				objectData.Set(name, bval)
 			case jsonparser.Array:
-				listVal, err := parseJsonList(env, value)
+				listVal, err := parseJsonList(env, value, scope)
 				if err != nil {
 					return err
 				}
-				objectData.Set(string(key), listVal)
+				objectData.Set(name, listVal)
 
 			default:
-				objectData.Set(string(key), value)
+				objectData.Set(name, value)
 
 			}
+			scope.add(name)
 			return nil
 		})
 
@@ -478,31 +699,30 @@ func parseJsonObject(env *cel.Env, jObj []byte) (*orderedmap.OrderedMap[string,
 	return objectData, nil
 }
 
-func parseJsonList(env *cel.Env, jObj []byte) ([]interface{}, error) {
+func parseJsonList(env *templateEnv, jObj []byte, scope *outputScope) ([]interface{}, error) {
 	var ourArray []interface{}
 	var lastError error
 	jsonparser.ArrayEach(jObj, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
 		switch dataType {
 		case jsonparser.Object:
-			objVal, err := parseJsonObject(env, value)
+			objVal, err := parseJsonObject(env, value, scope.child())
 			if err != nil {
 				lastError = err
 			}
 			ourArray = append(ourArray, objVal)
 		case jsonparser.String:
 			// We can attempt compilation
-			ast, issues := env.Compile(string(value))
-			if issues != nil && issues.Err() != nil {
+			expr, err := compileExpression(env, string(value), missingKeysDefault)
+			if err != nil {
 				return
-
 			}
 
-			prg, err := env.Program(ast)
-			if err != nil {
+			if err := scope.check(expr.ast); err != nil {
+				lastError = err
 				return
 			}
 
-			ourArray = append(ourArray, prg)
+			ourArray = append(ourArray, expr)
 		case jsonparser.Boolean:
 			bval, err := jsonparser.ParseBoolean(value)
 			if err != nil {
@@ -516,7 +736,7 @@ func parseJsonList(env *cel.Env, jObj []byte) ([]interface{}, error) {
 			}
 			ourArray = append(ourArray, bval)
 		case jsonparser.Array:
-			listVal, err := parseJsonList(env, value)
+			listVal, err := parseJsonList(env, value, scope)
 			if err != nil {
 				lastError = err
 			}
@@ -538,3 +758,55 @@ func getRemoveFunction() cel.EnvOption {
 		),
 	)
 }
+
+// getOmitFunctions provides shortcuts for removing a property depending on its value.
+// value_or_remove is non-strict so that it can remove the property when its argument fails to evaluate.
+func getOmitFunctions() []cel.EnvOption {
+	valueType := cel.TypeParamType("V")
+	remove := types.WrapErr(removeAttributeFromOutput)
+
+	return []cel.EnvOption{
+		cel.Function("omit_if_empty",
+			cel.Overload("omit_if_empty_V", []*cel.Type{valueType}, valueType,
+				cel.UnaryBinding(func(value ref.Val) ref.Val {
+					if value == types.NullValue {
+						return remove
+					}
+					if sizer, ok := value.(traits.Sizer); ok && sizer.Size() == types.IntZero {
+						return remove
+					}
+					return value
+				}),
+			),
+		),
+		cel.Function("omit_if_null",
+			cel.Overload("omit_if_null_V", []*cel.Type{valueType}, valueType,
+				cel.UnaryBinding(func(value ref.Val) ref.Val {
+					if value == types.NullValue {
+						return remove
+					}
+					return value
+				}),
+			),
+		),
+		cel.Function("value_or_remove",
+			cel.Overload("value_or_remove_V", []*cel.Type{valueType}, valueType,
+				cel.OverloadIsNonStrict(),
+				cel.UnaryBinding(func(value ref.Val) ref.Val {
+					if types.IsUnknownOrError(value) {
+						// Failures and fragment errors still stop the expansion
+						if errVal, ok := value.(*types.Err); ok {
+							var failure *TemplateFailure
+							var fragmentErr *FragmentError
+							if errors.As(errVal, &failure) || errors.As(errVal, &fragmentErr) {
+								return value
+							}
+						}
+						return remove
+					}
+					return value
+				}),
+			),
+		),
+	}
+}
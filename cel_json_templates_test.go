@@ -2,11 +2,15 @@ package celjsontemplates_test
 
 import (
 	"encoding/json"
+	"errors"
+	"os"
 	"strings"
 	"testing"
 
 	celjsontemplates "github.com/cms103/cel-json-templates"
 	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
 	"github.com/google/cel-go/ext"
 )
 
@@ -327,6 +331,1426 @@ func TestListOneArgFragmentOutput(t *testing.T) {
 	}
 }
 
+func TestManyArgFragmentOutput(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"sum": "fragment('sum', 1, 2, 3, 4, 5, 6, 7)"}`, celjsontemplates.WithFragments(map[string]string{
+		"sum": `{"total": "args.map(a, a).exists(a, a == 7) ? args[0] + args[6] : 0", "count": "args.size()"}`,
+	}))
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if string(res) != `{"sum":{"total":8,"count":7}}` {
+		t.Errorf("Unexpected output: %s\n", string(res))
+	}
+}
+
+func TestNamedFragmentParams(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"positional": "fragment('price', 10, 'EUR')",
+		"named": "fragment('price', {'currency': 'GBP', 'amount': data.age})",
+		"list": "data.prices.fragment('price', {'currency': 'USD'})"
+	}`, celjsontemplates.WithFragments(map[string]string{
+		"price": `{
+			"$params": ["amount", "currency"],
+			"value": "amount",
+			"currency": "currency"
+		}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ourT.Expand(map[string]interface{}{"age": 40, "prices": []interface{}{1, 2}})
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if string(res) != `{"positional":{"value":10,"currency":"EUR"},"named":{"value":40,"currency":"GBP"},"list":[{"value":1,"currency":"USD"},{"value":2,"currency":"USD"}]}` {
+		t.Errorf("Unexpected output: %s\n", string(res))
+	}
+}
+
+func TestUnknownNamedFragmentParam(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"named": "fragment('price', {'colour': 'red'})"}`, celjsontemplates.WithFragments(map[string]string{
+		"price": `{"$params": ["amount"], "value": "amount"}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ourT.Expand(referenceInputData)
+	var fragmentErr *celjsontemplates.FragmentError
+	if !errors.As(err, &fragmentErr) {
+		t.Errorf("Expected a FragmentError, got: %v", err)
+	}
+}
+
+func TestMapArgumentWithoutParams(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"single": "fragment('show', {'a': 1})",
+		"list": "data.prices.fragment('show', {'a': 2})",
+		"intKeys": "fragment('show', {1: 'one'})"
+	}`, celjsontemplates.WithFragments(map[string]string{
+		"show": `{"args": "args"}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ourT.Expand(map[string]interface{}{"prices": []interface{}{1}})
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if string(res) != `{"single":{"args":[{"a":1}]},"list":[{"args":[1,{"a":2}]}],"intKeys":{"args":[{"1":"one"}]}}` {
+		t.Errorf("Unexpected output: %s\n", string(res))
+	}
+}
+
+func TestInvalidFragmentParams(t *testing.T) {
+	_, err := celjsontemplates.New(`{}`, celjsontemplates.WithFragments(map[string]string{
+		"price": `{"$params": ["args"], "value": "args"}`,
+	}))
+	if err == nil {
+		t.Error("Expected an error for a parameter that clashes with args")
+	}
+}
+
+func TestFragmentContext(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"orders": "data.orders.fragment('order')"}`, celjsontemplates.WithFragments(map[string]string{
+		"order": `{
+			"$params": ["order"],
+			"id": "order.id",
+			"customer": "data.customer",
+			"lines": "order.lines.fragment('line')"
+		}`,
+		"line": `{
+			"$params": ["line"],
+			"order": "parent.order.id",
+			"position": "string(index + 1) + '/' + string(length)",
+			"first": "first",
+			"last": "last",
+			"sku": "line"
+		}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ourT.Expand(map[string]interface{}{
+		"customer": "Bob",
+		"orders": []interface{}{
+			map[string]interface{}{"id": 1, "lines": []interface{}{"a", "b"}},
+		},
+	})
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if string(res) != `{"orders":[{"id":1,"customer":"Bob","lines":[{"order":1,"position":"1/2","first":true,"last":false,"sku":"a"},{"order":1,"position":"2/2","first":false,"last":true,"sku":"b"}]}]}` {
+		t.Errorf("Unexpected output: %s\n", string(res))
+	}
+}
+
+func TestListFragmentOverCelValues(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"literal": "[1, 2].fragment('item')",
+		"strings": "data.names.fragment('item')",
+		"filtered": "data.list1.filter(i, i > 7).fragment('item')"
+	}`, celjsontemplates.WithFragments(map[string]string{
+		"item": `{"value": "args[0]"}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ourT.Expand(map[string]interface{}{
+		"names": []string{"a", "b"},
+		"list1": []interface{}{1, 8, 9},
+	})
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if string(res) != `{"literal":[{"value":1},{"value":2}],"strings":[{"value":"a"},{"value":"b"}],"filtered":[{"value":8},{"value":9}]}` {
+		t.Errorf("Unexpected output: %s\n", string(res))
+	}
+}
+
+func TestMapFragment(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"prices": "data.prices.fragment('priceRow', 'EUR')"}`, celjsontemplates.WithFragments(map[string]string{
+		"priceRow": `{
+			"$params": ["product", "price", "currency"],
+			"product": "product",
+			"price": "price",
+			"currency": "currency",
+			"last": "last"
+		}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ourT.Expand(map[string]interface{}{
+		"prices": map[string]interface{}{"tea": 2, "coffee": 3},
+	})
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if string(res) != `{"prices":[{"product":"coffee","price":3,"currency":"EUR","last":false},{"product":"tea","price":2,"currency":"EUR","last":true}]}` {
+		t.Errorf("Unexpected output: %s\n", string(res))
+	}
+}
+
+func TestFragmentNotIterable(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"bad": "data.name.fragment('item')"}`, celjsontemplates.WithFragments(map[string]string{
+		"item": `{"value": "args[0]"}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ourT.Expand(referenceInputData)
+	if !errors.Is(err, celjsontemplates.ErrFragmentNotIterable) {
+		t.Errorf("Expected a not iterable error, got: %v", err)
+	}
+}
+
+func TestFragmentResultMapSemantics(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"size": "fragment('pair').size()",
+		"has": "has(fragment('pair').a)",
+		"hasNot": "has(fragment('pair').z)",
+		"in": "'b' in fragment('pair')",
+		"equal": "fragment('pair') == {'a': 1, 'b': 'two'}",
+		"notEqual": "fragment('pair') == {'a': 1}",
+		"keys": "fragment('pair').map(k, k)",
+		"filter": "fragment('pair').filter(k, k != 'a')",
+		"exists": "fragment('pair').exists(k, fragment('pair')[k] == 'two')",
+		"type": "type(fragment('pair')) == map",
+		"entries": "fragment('pair').fragment('entry')"
+	}`, celjsontemplates.WithFragments(map[string]string{
+		"pair":  `{"a": "1", "b": "'two'"}`,
+		"entry": `{"key": "args[0]", "value": "args[1]"}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if string(res) != `{"size":2,"has":true,"hasNot":false,"in":true,"equal":true,"notEqual":false,"keys":["a","b"],"filter":["b"],"exists":true,"type":true,"entries":[{"key":"a","value":1},{"key":"b","value":"two"}]}` {
+		t.Errorf("Unexpected output: %s\n", string(res))
+	}
+}
+
+func TestRecursiveFragmentOutput(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"tree": "fragment('node', data.tree)"}`, celjsontemplates.WithFragments(map[string]string{
+		"node": `{
+			"Name": "args[0].name",
+			"Children": "args[0].children.fragment('node')"
+		}`}))
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err := ourT.Expand(map[string]interface{}{
+		"tree": map[string]interface{}{
+			"name": "root",
+			"children": []interface{}{
+				map[string]interface{}{"name": "left", "children": []interface{}{}},
+				map[string]interface{}{"name": "right", "children": []interface{}{
+					map[string]interface{}{"name": "leaf", "children": []interface{}{}},
+				}},
+			},
+		},
+	})
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if string(res) != `{"tree":{"Name":"root","Children":[{"Name":"left","Children":[]},{"Name":"right","Children":[{"Name":"leaf","Children":[]}]}]}}` {
+		t.Errorf("Unexpected output: %s\n", string(res))
+	}
+}
+
+func TestFragmentDepthExceeded(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"loop": "fragment('ping')"}`, celjsontemplates.WithMaxFragmentDepth(4), celjsontemplates.WithFragments(map[string]string{
+		"ping": `{"next": "fragment('pong')"}`,
+		"pong": `{"next": "fragment('ping')"}`,
+	}))
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = ourT.Expand(referenceInputData)
+	if !errors.Is(err, celjsontemplates.ErrFragmentDepthExceeded) {
+		t.Fatalf("Expected depth exceeded error, got: %v", err)
+	}
+
+	var fragmentErr *celjsontemplates.FragmentError
+	if !errors.As(err, &fragmentErr) {
+		t.Fatalf("Expected a FragmentError, got: %v", err)
+	}
+
+	if strings.Join(fragmentErr.Stack, ",") != "ping,pong,ping,pong,ping" {
+		t.Errorf("Unexpected fragment stack: %v", fragmentErr.Stack)
+	}
+}
+
+func TestFragmentNotFound(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"missing": "fragment('nothere')"}`)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = ourT.Expand(referenceInputData)
+	if !errors.Is(err, celjsontemplates.ErrFragmentNotFound) {
+		t.Errorf("Expected fragment not found error, got: %v", err)
+	}
+}
+
+func TestMacrosWithFragmentResults(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"map": "[1, 2].map(val, fragment('name', val))",
+		"filter": "[1, 2, 3].map(val, fragment('name', val)).filter(f, f.Value > 1)",
+		"nested": "[[1], [2, 3]].map(l, l.map(val, fragment('name', val)))",
+		"literal": "{'b': fragment('name', 2), 'a': fragment('name', 1)}",
+		"all": "[1, 2].map(val, fragment('name', val)).all(f, f.Value > 0)"
+	}`, celjsontemplates.WithFragments(map[string]string{
+		"name": `{"Value": "args[0]"}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if string(res) != `{"map":[{"Value":1},{"Value":2}],"filter":[{"Value":2},{"Value":3}],"nested":[[{"Value":1}],[{"Value":2},{"Value":3}]],"literal":{"a":{"Value":1},"b":{"Value":2}},"all":true}` {
+		t.Errorf("Unexpected output: %s\n", string(res))
+	}
+}
+
+// TestBadMapExample is a regression test for the examples/badmap example, which used to produce empty objects
+func TestBadMapExample(t *testing.T) {
+	template, err := os.ReadFile("examples/badmap/template.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fragmentData, err := os.ReadFile("examples/badmap/fragments.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rawFragments map[string]json.RawMessage
+	err = json.Unmarshal(fragmentData, &rawFragments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fragments := make(map[string]string)
+	for name, fragment := range rawFragments {
+		fragments[name] = string(fragment)
+	}
+
+	inputData, err := os.ReadFile("examples/badmap/input.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var input map[string]interface{}
+	err = json.Unmarshal(inputData, &input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ourT, err := celjsontemplates.New(string(template), celjsontemplates.WithFragments(fragments))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ourT.Expand(input)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if string(res) != `{"test":[{"Value":1},{"Value":2}]}` {
+		t.Errorf("Unexpected output: %s\n", string(res))
+	}
+}
+
+func TestLetBindings(t *testing.T) {
+	calls := 0
+	counter := cel.Function("lookup",
+		cel.Overload("lookup_string", []*cel.Type{cel.StringType}, cel.StringType,
+			cel.UnaryBinding(func(arg ref.Val) ref.Val {
+				calls++
+				return arg
+			}),
+		),
+	)
+
+	ourT, err := celjsontemplates.New(`{
+		"$let": {"name": "lookup(data.person.Name)", "greeting": "'Hello ' + name"},
+		"greeting": "greeting",
+		"upper": "name + '!'",
+		"address": {
+			"$let": {"addr": "data.person.Address"},
+			"line1": "addr.Line1",
+			"owner": "name"
+		}
+	}`, celjsontemplates.WithCelOptions([]cel.EnvOption{counter}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if string(res) != `{"greeting":"Hello Bob","upper":"Bob!","address":{"line1":"Here Street","owner":"Bob"}}` {
+		t.Errorf("Unexpected output: %s\n", string(res))
+	}
+
+	if calls != 1 {
+		t.Errorf("Expected the let expression to be evaluated once, got %d", calls)
+	}
+}
+
+func TestLetBindingScope(t *testing.T) {
+	_, err := celjsontemplates.New(`{
+		"address": {
+			"$let": {"addr": "data.person.Address"},
+			"line1": "addr.Line1"
+		},
+		"line2": "addr.Line2"
+	}`)
+	if err == nil || !strings.Contains(err.Error(), "undeclared reference to 'addr'") {
+		t.Errorf("Expected a compile error for a variable used out of scope, got: %v", err)
+	}
+}
+
+func TestLetBindingReservedNames(t *testing.T) {
+	for _, name := range []string{"data", "ref", "self", "root", "__expansion__"} {
+		_, err := celjsontemplates.New(`{"$let": {"` + name + `": "1"}, "x": "1"}`)
+		if err == nil || err.Error() != "$let: variable "+name+" is already in use" {
+			t.Errorf("Expected an error for the variable %s, got: %v", name, err)
+		}
+	}
+}
+
+func TestLetBindingTypeCheck(t *testing.T) {
+	_, err := celjsontemplates.New(`{"$let": {"n": "'a'"}, "x": "n + 1"}`)
+	if err == nil {
+		t.Error("Expected a type error when adding an int to a string variable")
+	}
+}
+
+func TestOutputReferences(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"total": "data.age * 2",
+		"totalWithTax": "self.total + 8",
+		"summary": {"total": "root.total", "hasTax": "has(root.totalWithTax)", "doubled": "self.total * 2"},
+		"items": ["self.total", {"copy": "root['totalWithTax']"}]
+	}`, celjsontemplates.WithOutputReferences())
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if string(res) != `{"total":80,"totalWithTax":88,"summary":{"total":80,"hasTax":true,"doubled":160},"items":[80,{"copy":88}]}` {
+		t.Errorf("Unexpected output: %s", string(res))
+	}
+}
+
+func TestOutputReferencesCompileChecks(t *testing.T) {
+	badTemplates := []string{
+		// Forward reference
+		`{"a": "self.b", "b": 1}`,
+		// Cyclic reference
+		`{"a": "self.a"}`,
+		// The enclosing top level key isn't complete yet
+		`{"x": {"y": "root.x"}}`,
+		// Keys have to be known when the template is compiled
+		`{"a": 1, "b": "self[data.name]"}`,
+		`{"a": 1, "b": "size(self)"}`,
+	}
+
+	for _, template := range badTemplates {
+		_, err := celjsontemplates.New(template, celjsontemplates.WithOutputReferences())
+		if err == nil {
+			t.Errorf("Expected a compile error for %s", template)
+		}
+	}
+}
+
+func TestOutputReferencesDisabled(t *testing.T) {
+	_, err := celjsontemplates.New(`{"a": 1, "b": "self.a"}`)
+	if err == nil || !strings.Contains(err.Error(), "undeclared reference to 'self'") {
+		t.Errorf("Expected self to be undeclared by default, got: %v", err)
+	}
+}
+
+func TestFail(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"name": "data.name", "items": [1, {"price": "fail('bad price', data.age)"}]}`)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = ourT.Expand(referenceInputData)
+	failure, ok := err.(*celjsontemplates.TemplateFailure)
+	if !ok {
+		t.Fatalf("Expected a TemplateFailure, got: %v", err)
+	}
+	if failure.Message != "bad price" || failure.Path != "$.items[1].price" || failure.Detail != int64(40) {
+		t.Errorf("Unexpected failure: %+v", failure)
+	}
+	if err.Error() != "template failure at $.items[1].price: bad price" {
+		t.Errorf("Unexpected error message: %v", err)
+	}
+}
+
+func TestFailIf(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"check": "fail_if(data.age < 18, 'too young')",
+		"age": "fail_if(data.age > 100, 'too old', data.age)"
+	}`)
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+	if string(res) != `{"age":40}` {
+		t.Errorf("Unexpected output: %s", string(res))
+	}
+
+	_, err = ourT.Expand(map[string]interface{}{"age": 12})
+	var failure *celjsontemplates.TemplateFailure
+	if !errors.As(err, &failure) || failure.Path != "$.check" || failure.Message != "too young" {
+		t.Errorf("Expected a TemplateFailure for check, got: %v", err)
+	}
+}
+
+func TestFailInFragment(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"rows": "data.list1.fragment('row')"}`, celjsontemplates.WithFragments(map[string]string{
+		"row": `{"value": "fail_if(args[0] == 3, 'three is not allowed', args[0])"}`,
+	}))
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = ourT.Expand(referenceInputData)
+	var failure *celjsontemplates.TemplateFailure
+	if !errors.As(err, &failure) || failure.Path != "$.rows[2].value" {
+		t.Errorf("Expected a TemplateFailure for $.rows[2].value, got: %v", err)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"medal": "data.status in ref.medals ? ref.medals[data.status] : warn('unknown status', 'None')",
+		"rows": "data.list1.slice(0, 3).fragment('row')"
+	}`, celjsontemplates.WithRef(map[string]interface{}{
+		"medals": map[int]interface{}{1: "Bronze"},
+	}), celjsontemplates.WithFragments(map[string]string{
+		"row": `{"value": "args[0] == 2 ? warn('two found') : args[0]"}`,
+	}), celjsontemplates.WithCelOptions([]cel.EnvOption{ext.Lists()}))
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, warnings, err := ourT.ExpandWithReport(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if string(res) != `{"medal":"None","rows":[{"value":1},{"value":null},{"value":3}]}` {
+		t.Errorf("Unexpected output: %s", string(res))
+	}
+
+	if len(warnings) != 2 || warnings[0].String() != "$.medal: unknown status" || warnings[1].String() != "$.rows[1].value: two found" {
+		t.Errorf("Unexpected warnings: %v", warnings)
+	}
+}
+
+func TestOmitFunctions(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"emptyList": "omit_if_empty(data.list1.filter(i, i > 100))",
+		"emptyString": "omit_if_empty('')",
+		"list": "omit_if_empty(data.list1.filter(i, i > 8))",
+		"null": "omit_if_null(null)",
+		"name": "omit_if_null(data.name)",
+		"missing": "value_or_remove(data.person.Phone)",
+		"age": "value_or_remove(data.person.Age)"
+	}`, celjsontemplates.WithMissingKeyErrors())
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if string(res) != `{"list":[9],"name":"a test name","age":22}` {
+		t.Errorf("Unexpected output: %s", string(res))
+	}
+}
+
+func TestValueOrRemoveKeepsFailures(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"a": "value_or_remove(fail('stop'))"}`)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = ourT.Expand(referenceInputData)
+	if _, ok := err.(*celjsontemplates.TemplateFailure); !ok {
+		t.Errorf("Expected a TemplateFailure, got: %v", err)
+	}
+}
+
+func TestPruneEmpty(t *testing.T) {
+	template := `{"name": "data.name", "contact": {"phone": "data.phone", "email": "data.email"}, "tags": ["data.tag"], "nested": {"list": ["data.tag"]}}`
+
+	ourT, err := celjsontemplates.New(template)
+	if err != nil {
+		t.Error(err)
+	}
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+	if string(res) != `{"name":"a test name","contact":{},"tags":[],"nested":{"list":[]}}` {
+		t.Errorf("Unexpected output: %s", string(res))
+	}
+
+	ourT, err = celjsontemplates.New(template, celjsontemplates.WithPruneEmpty())
+	if err != nil {
+		t.Error(err)
+	}
+	res, err = ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+	if string(res) != `{"name":"a test name"}` {
+		t.Errorf("Unexpected output: %s", string(res))
+	}
+}
+
+func TestKeyMarkers(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"id!": "data.test", "email?": "data.email", "really??": "true", "wow!!": "data.name"}`, celjsontemplates.WithMissingKeyErrors())
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if string(res) != `{"id":"avalue","really?":true,"wow!":"a test name"}` {
+		t.Errorf("Unexpected output: %s", string(res))
+	}
+}
+
+func TestMarkerOnlyKey(t *testing.T) {
+	for _, key := range []string{"?", "!"} {
+		_, err := celjsontemplates.New(`{"` + key + `": "data.name"}`)
+		if err == nil || err.Error() != "key "+key+": a marker must follow the name of the key" {
+			t.Errorf("Expected an error for the key %s, got: %v", key, err)
+		}
+	}
+}
+
+func TestRequiredKeyMarker(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"name": "data.name", "email": "data.email", "id!": "data.id"}`)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = ourT.Expand(referenceInputData)
+	if err == nil || !strings.Contains(err.Error(), "no such key: id") {
+		t.Errorf("Expected a missing key error for id, got: %v", err)
+	}
+}
+
+func TestRequiredKeyMarkerWithLet(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"$let": {"c": "data.contact"}, "email": "c.email", "name!": "c.name"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ourT.Expand(referenceInputData)
+	if err == nil || !strings.Contains(err.Error(), "no such key: contact") {
+		t.Errorf("Expected a missing key error for contact, got: %v", err)
+	}
+}
+
+func TestKeyMarkerOnObject(t *testing.T) {
+	_, err := celjsontemplates.New(`{"contact?": {"email": "data.email"}}`)
+	if err == nil {
+		t.Error("Expected an error for a marker on an object")
+	}
+}
+
+func TestOptionalTypes(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"phone": "data.?person.?Phone.orValue('unknown')",
+		"line1": "data.?person.?Address.?Line1",
+		"city": "data.?person.?Address.?City",
+		"list": ["optional.none()", "optional.of(1)", "[?data.?missing, ?data.?age]"]
+	}`, celjsontemplates.WithOptionalTypes(), celjsontemplates.WithMissingKeyErrors())
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if string(res) != `{"phone":"unknown","line1":"Here Street","list":[1,[40]]}` {
+		t.Errorf("Unexpected output: %s", string(res))
+	}
+}
+
+const referenceDataSchema = `{
+	"type": "object",
+	"properties": {
+		"test": {"type": "string"},
+		"name": {"type": "string"},
+		"age": {"type": "integer"},
+		"sub1": {"type": "integer"},
+		"status": {"type": "integer"},
+		"person": {"$ref": "#/$defs/person"},
+		"list1": {"type": "array", "items": {"type": "integer"}}
+	},
+	"$defs": {
+		"person": {
+			"type": "object",
+			"properties": {
+				"Name": {"type": "string"},
+				"Age": {"type": "number"},
+				"Address": {"type": "object", "additionalProperties": {"type": "string"}}
+			}
+		}
+	}
+}`
+
+func TestDataSchema(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"name": "data.name",
+		"next": "data.age + 1",
+		"half": "data.person.Age / 2.0",
+		"line1": "data.person.Address.Line1",
+		"doubled": "data.list1.filter(i, i < 3).map(i, i * 2)"
+	}`, celjsontemplates.WithDataSchema([]byte(referenceDataSchema)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+	if string(res) != `{"name":"a test name","next":41,"half":11,"line1":"Here Street","doubled":[2,4]}` {
+		t.Errorf("Unexpected output: %s", string(res))
+	}
+
+	// Numbers decoded from JSON are converted to integers
+	res, err = ourT.Expand(map[string]interface{}{"age": 40.0})
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+	if string(res) != `{"next":41}` {
+		t.Errorf("Unexpected output: %s", string(res))
+	}
+}
+
+func TestDataSchemaCompileErrors(t *testing.T) {
+	_, err := celjsontemplates.New(`{"name": "data.fristName"}`, celjsontemplates.WithDataSchema([]byte(referenceDataSchema)))
+	if err == nil || !strings.Contains(err.Error(), "undefined field 'fristName'") {
+		t.Errorf("Expected an undefined field error, got: %v", err)
+	}
+
+	_, err = celjsontemplates.New(`{"name": "data.person.Name + 1"}`, celjsontemplates.WithDataSchema([]byte(referenceDataSchema)))
+	if err == nil || !strings.Contains(err.Error(), "no matching overload") {
+		t.Errorf("Expected a type error, got: %v", err)
+	}
+
+	_, err = celjsontemplates.New(`{"name": "data.name"}`, celjsontemplates.WithDataSchema([]byte(`{"type": "array"}`)))
+	if err == nil {
+		t.Error("Expected an error for a schema that doesn't describe an object")
+	}
+}
+
+var typedRefData = map[string]interface{}{
+	"categories": map[string]interface{}{"u": "Unknown", "a": "Adult"},
+	"medals":     map[int]interface{}{1: "Bronze", 2: "Silver"},
+	"defaults":   map[string]interface{}{"country": "UK", "age": 18},
+	"customers": []interface{}{
+		map[string]interface{}{"id": 1, "name": "Bob"},
+		map[string]interface{}{"id": 2, "name": "Jane"},
+	},
+}
+
+func TestTypedRef(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"category": "ref.categories['a']",
+		"medal": "ref.medals[data.status]",
+		"age": "ref.defaults.age + 1",
+		"customer": "ref.customers.filter(c, c.id == 2)[0].name"
+	}`, celjsontemplates.WithRef(typedRefData), celjsontemplates.WithTypedRef())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+	if string(res) != `{"category":"Adult","medal":"Silver","age":19,"customer":"Jane"}` {
+		t.Errorf("Unexpected output: %s", string(res))
+	}
+}
+
+func TestTypedRefCompileErrors(t *testing.T) {
+	badTemplates := map[string]string{
+		`{"c": "ref.categoriez['a']"}`:         "undefined field 'categoriez'",
+		`{"c": "ref.defaults.country + 1"}`:    "no matching overload",
+		`{"c": "ref.customers[0].nmae"}`:       "undefined field 'nmae'",
+		`{"c": "ref.categories['a'] == 1"}`:    "no matching overload",
+		`{"c": "ref.medals['1']"}`:             "no matching overload",
+		`{"c": "ref.defaults.age.size() > 1"}`: "no matching overload",
+	}
+
+	for template, expected := range badTemplates {
+		_, err := celjsontemplates.New(template, celjsontemplates.WithRef(typedRefData), celjsontemplates.WithTypedRef())
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error containing %q for %s, got: %v", expected, template, err)
+		}
+	}
+}
+
+func TestOutputSchema(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"name": "data.name",
+		"count!": "size(data.list1)",
+		"kind": "'person'",
+		"tags": "omit_if_empty(['a'])",
+		"rows": "data.list1.fragment('row')",
+		"other": "data.ok ? fragment('row', 1) : null",
+		"nested": {"when": "timestamp('2023-01-01T00:00:00Z')", "list": ["1", "'a'", "2"]}
+	}`, celjsontemplates.WithFragments(map[string]string{
+		"row": `{"value": "args[0]", "children": "args[0].fragment('row')"}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema, err := ourT.OutputSchema()
+	if err != nil {
+		t.Errorf("Error generating schema: %v", err)
+	}
+
+	expected := `{"$schema":"https://json-schema.org/draft/2020-12/schema","type":"object","properties":{` +
+		`"name":{},"count":{"type":"integer"},"kind":{"type":"string"},"tags":{"type":"array","items":{"type":"string"}},` +
+		`"rows":{"type":"array","items":{"$ref":"#/$defs/fragment.row"}},"other":{"anyOf":[{"$ref":"#/$defs/fragment.row"},{"type":"null"}]},` +
+		`"nested":{"type":"object","properties":{"when":{"type":"string","format":"date-time"},"list":{"type":"array","items":{"anyOf":[{"type":"integer"},{"type":"string"}]}}},"required":["when","list"],"additionalProperties":false}},` +
+		`"required":["count","kind","nested"],"additionalProperties":false,` +
+		`"$defs":{"fragment.row":{"type":"object","properties":{"value":{},"children":{"type":"array","items":{"$ref":"#/$defs/fragment.row"}}},"additionalProperties":false}}}`
+	if string(schema) != expected {
+		t.Errorf("Unexpected schema: %s", string(schema))
+	}
+}
+
+const outputCheckSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string", "minLength": 2},
+		"code?": {"type": "string", "pattern": "^[A-Z]+$"},
+		"rows": {"type": "array", "items": {"$ref": "#/$defs/row"}, "maxItems": 3}
+	},
+	"required": ["name", "rows"],
+	"additionalProperties": false,
+	"$defs": {
+		"row": {
+			"type": "object",
+			"properties": {"value": {"type": "integer", "minimum": 1}, "label": {"enum": ["one", "two"]}},
+			"required": ["value"]
+		}
+	}
+}`
+
+func TestOutputSchemaValidation(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"name": "data.name",
+		"code??": "data.code",
+		"rows": "data.values.fragment('row')",
+		"extra": "data.extra"
+	}`, celjsontemplates.WithOutputSchema([]byte(outputCheckSchema)), celjsontemplates.WithFragments(map[string]string{
+		"row": `{"value": "args[0]", "label": "args[0] == 1 ? 'one' : args[0] == 2 ? 'two' : 'many'"}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ourT.Expand(map[string]interface{}{"name": "Bob", "code": "AB", "values": []interface{}{1, 2}})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if string(res) != `{"name":"Bob","code?":"AB","rows":[{"value":1,"label":"one"},{"value":2,"label":"two"}]}` {
+		t.Errorf("Unexpected result: %s", string(res))
+	}
+
+	_, err = ourT.Expand(map[string]interface{}{"name": "B", "code": "ab", "values": []interface{}{1, 0}, "extra": map[string]interface{}{"labels": []interface{}{"x"}}})
+	var schemaErr *celjsontemplates.OutputSchemaError
+	if !errors.As(err, &schemaErr) {
+		t.Fatalf("Expected an OutputSchemaError, got %v", err)
+	}
+	expected := []string{
+		"/name (template #/name): string is shorter than the minimum length of 2",
+		"/code? (template #/code??): string doesn't match the pattern ^[A-Z]+$",
+		"/rows/1/value (template row#/value): 0 is less than the minimum of 1",
+		"/rows/1/label (template row#/label): value must be one of [\"one\",\"two\"]",
+		"/extra (template #/extra): property is not allowed",
+	}
+	if len(schemaErr.Violations) != len(expected) {
+		t.Fatalf("Unexpected violations: %v", schemaErr)
+	}
+	for i, violation := range schemaErr.Violations {
+		if violation.String() != expected[i] {
+			t.Errorf("Unexpected violation %d: %s", i, violation)
+		}
+	}
+}
+
+func TestOutputSchemaValidationOfData(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"name": "data.name", "rows": "data.rows"}`,
+		celjsontemplates.WithOutputSchema([]byte(outputCheckSchema)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ourT.Expand(map[string]interface{}{
+		"rows": []interface{}{map[string]interface{}{"value": 1.5}, map[string]interface{}{}, 1, 2},
+	})
+	if err == nil || err.Error() != "output doesn't match schema: "+
+		"(root) (template #): missing required property name; "+
+		"/rows (template #/rows): array has more than the maximum of 3 items; "+
+		"/rows/0/value (template #/rows): expected integer, got number; "+
+		"/rows/1 (template #/rows): missing required property value; "+
+		"/rows/2 (template #/rows): expected object, got integer; "+
+		"/rows/3 (template #/rows): expected object, got integer" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestOutputSchemaErrors(t *testing.T) {
+	_, err := celjsontemplates.New(`{"name": "data.name"}`,
+		celjsontemplates.WithOutputSchema([]byte(`{"$ref": "https://example.com/schema.json"}`)))
+	if err == nil || err.Error() != "output schema: only local references are supported, got https://example.com/schema.json" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	_, err = celjsontemplates.New(`{"name": "data.name"}`,
+		celjsontemplates.WithOutputSchema([]byte(`{"properties": {"name": {"$ref": "#/$defs/missing"}}}`)))
+	if err == nil || err.Error() != "output schema: unable to resolve reference #/$defs/missing" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	_, err = celjsontemplates.New(`{"tags": "data.tags"}`,
+		celjsontemplates.WithOutputSchema([]byte(`{"properties": {"tags": {"items": {"type": "string"}, "contains": {"const": "z"}}}}`)))
+	if err == nil || err.Error() != "output schema: the contains keyword isn't supported" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Properties can have the same name as an unsupported keyword
+	_, err = celjsontemplates.New(`{"contains": "data.name"}`,
+		celjsontemplates.WithOutputSchema([]byte(`{"properties": {"contains": {"type": "string"}}}`)))
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"$require": {
+			"size(data.items) > 0": "order must have items",
+			"data.total >= 0": "total must not be negative",
+			"data.customer.id != ''": "customer must have an id"
+		},
+		"items": "size(data.items)",
+		"total": "data.total"
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ourT.Expand(map[string]interface{}{"items": []interface{}{1}, "total": 10, "customer": map[string]interface{}{"id": "c1"}})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if string(res) != `{"items":1,"total":10}` {
+		t.Errorf("Unexpected result: %s", string(res))
+	}
+
+	_, err = ourT.Expand(map[string]interface{}{"items": []interface{}{}, "total": -1})
+	var requireErr *celjsontemplates.RequirementError
+	if !errors.As(err, &requireErr) {
+		t.Fatalf("Expected a RequirementError, got %v", err)
+	}
+	if len(requireErr.Failures) != 3 {
+		t.Fatalf("Unexpected failures: %v", requireErr)
+	}
+	if requireErr.Failures[0].Expression != "size(data.items) > 0" || requireErr.Failures[0].Message != "order must have items" || requireErr.Failures[0].Err != nil {
+		t.Errorf("Unexpected failure: %v", requireErr.Failures[0])
+	}
+	if requireErr.Failures[1].Message != "total must not be negative" {
+		t.Errorf("Unexpected failure: %v", requireErr.Failures[1])
+	}
+	// The missing customer can't be evaluated, which also fails the precondition
+	if requireErr.Failures[2].Message != "customer must have an id" || requireErr.Failures[2].Err == nil {
+		t.Errorf("Unexpected failure: %v", requireErr.Failures[2])
+	}
+	if err.Error() != "data doesn't meet the template requirements: order must have items; total must not be negative; customer must have an id (no such key: customer)" {
+		t.Errorf("Unexpected error message: %v", err)
+	}
+}
+
+func TestRequireCompileErrors(t *testing.T) {
+	_, err := celjsontemplates.New(`{"$require": {"size(data.items)": "order must have items"}}`)
+	if err == nil || err.Error() != "$require: size(data.items) must be a bool expression, not int" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	_, err = celjsontemplates.New(`{"$require": ["data.ok"]}`)
+	if err == nil || err.Error() != "$require must be an object of expressions and messages" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	_, err = celjsontemplates.New(`{"$require": {"self.a > 0": "a must be positive"}, "a": "1"}`, celjsontemplates.WithOutputReferences())
+	if err == nil || err.Error() != "$require: self.a > 0: self.a refers to an output key that isn't computed before this expression" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	_, err = celjsontemplates.New(`{}`, celjsontemplates.WithFragments(map[string]string{
+		"row": `{"$require": {"false": "never"}, "a": "1"}`,
+	}))
+	if err == nil || err.Error() != "fragment row: $require is only allowed at the top level of the template" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	_, err = celjsontemplates.New(`{"o": {"$require": {"data.ok": "must be ok"}, "a": "1"}}`)
+	if err == nil || err.Error() != "$require is only allowed at the top level of the template" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestRequireWithOutputReferences(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"$require": {"fragment('check').ok": "check must pass"},
+		"a": "1",
+		"b": "root.a + 1"
+	}`, celjsontemplates.WithOutputReferences(), celjsontemplates.WithFragments(map[string]string{
+		"check": `{"ok": "true"}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if string(res) != `{"a":1,"b":2}` {
+		t.Errorf("Unexpected result: %s", string(res))
+	}
+}
+
+func TestReferences(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"$require": {"size(data.items) > 0": "order must have items"},
+		"$let": {"country": "ref.countries[data.address.country]"},
+		"name??": "has(data.person.name) ? data.person.name : 'unknown'",
+		"first": "data.items[0].code",
+		"prices": "data.items.map(i, i.price * ref.rate)",
+		"lines": ["data['delivery-notes']", "fragment('row', data.items)"]
+	}`, celjsontemplates.WithFragments(map[string]string{
+		"row": `{"total": "args[0].price + data.shipping"}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found []string
+	for _, reference := range ourT.References() {
+		found = append(found, reference.Template+" "+reference.Path)
+	}
+	expected := []string{
+		"#/$require/size(data.items) > 0 data.items",
+		"#/$let/country data.address.country",
+		"#/$let/country ref.countries[*]",
+		"#/name?? data.person.name",
+		"#/first data.items[0].code",
+		"#/prices data.items",
+		"#/prices data.items[*].price",
+		"#/prices ref.rate",
+		`#/lines/0 data["delivery-notes"]`,
+		"#/lines/1 data.items",
+		"row#/total data.shipping",
+	}
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected references:\n%s", strings.Join(found, "\n"))
+	}
+}
+
+func TestLineage(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"$let": {"customer": "data.customer", "rate": "ref.rates[data.currency]"},
+		"name": "customer.name",
+		"kind": "'order'",
+		"rows": "data.items.fragment('row', rate)",
+		"main": "fragment('summary', {'total': data.total})",
+		"notes": ["data.notes.map(n, fragment('note', n))"]
+	}`, celjsontemplates.WithFragments(map[string]string{
+		"row":     `{"price": "args[0].price * args[1]", "code": "args[0].code"}`,
+		"summary": `{"$params": ["total"], "total": "total", "shipping": "data.shipping"}`,
+		"note":    `{"text": "args[0].text"}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lineage, err := ourT.Lineage().Json()
+	if err != nil {
+		t.Errorf("Error encoding lineage: %v", err)
+	}
+	expected := `{"$.name":["data.customer.name"],"$.kind":[],` +
+		`"$.rows":["data.currency","data.items","ref.rates[*]"],"$.rows[*].price":["data.currency","data.items[*].price","ref.rates[*]"],"$.rows[*].code":["data.items[*].code"],` +
+		`"$.main":["data.total"],"$.main.total":["data.total"],"$.main.shipping":["data.shipping"],` +
+		`"$.notes[0]":["data.notes","data.notes[*]"],"$.notes[0][*].text":["data.notes[*].text"]}`
+	if string(lineage) != expected {
+		t.Errorf("Unexpected lineage: %s", string(lineage))
+	}
+}
+
+func TestLineageConditionalFragments(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"x": "data.c ? fragment('a') : fragment('b')"}`, celjsontemplates.WithFragments(map[string]string{
+		"a": `{"name": "data.first"}`,
+		"b": `{"name": "data.last", "title": "'none'"}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lineage, err := ourT.Lineage().Json()
+	if err != nil {
+		t.Errorf("Error encoding lineage: %v", err)
+	}
+	if string(lineage) != `{"$.x":["data.c"],"$.x.name":["data.first","data.last"],"$.x.title":[]}` {
+		t.Errorf("Unexpected lineage: %s", string(lineage))
+	}
+}
+
+func TestLineageDot(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"name": "data.first + ' ' + data['last-name']", "kind": "'person'"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `digraph lineage {
+  rankdir=LR;
+  "$.name" [shape=box];
+  "data.first" -> "$.name";
+  "data[\"last-name\"]" -> "$.name";
+  "$.kind" [shape=box];
+}
+`
+	if dot := ourT.Lineage().Dot(); dot != expected {
+		t.Errorf("Unexpected graph: %s", dot)
+	}
+}
+
+func TestConstantFolding(t *testing.T) {
+	calls := 0
+	counter := cel.Function("counted",
+		cel.Overload("counted_string", []*cel.Type{cel.StringType}, cel.StringType,
+			cel.UnaryBinding(func(value ref.Val) ref.Val {
+				calls++
+				return value
+			}),
+		),
+	)
+	reference := map[string]interface{}{"categories": map[string]interface{}{"u": "User"}}
+	template := `{
+		"Category": "ref.categories['u']",
+		"Label": "'Hob' + 'by'",
+		"Counted": "counted(ref.categories['u'])",
+		"Name": "counted(data.name)",
+		"Missing": "ref.categories['x']"
+	}`
+
+	ourT, err := celjsontemplates.New(template, celjsontemplates.WithRef(reference), celjsontemplates.WithCelOptions([]cel.EnvOption{counter}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 0 {
+		t.Errorf("Expected functions added with WithCelOptions not to be evaluated by New, got %d calls", calls)
+	}
+
+	// Changes to the reference data are only seen by expressions that weren't folded
+	reference["categories"].(map[string]interface{})["u"] = "Changed"
+	for i := 0; i < 2; i++ {
+		res, err := ourT.Expand(map[string]interface{}{"name": "Bob"})
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if string(res) != `{"Category":"User","Label":"Hobby","Counted":"Changed","Name":"Bob"}` {
+			t.Errorf("Unexpected result: %s", string(res))
+		}
+	}
+	if calls != 4 {
+		t.Errorf("Expected expressions using functions added with WithCelOptions to be evaluated on every expansion, got %d calls", calls)
+	}
+
+	ourT, err = celjsontemplates.New(template, celjsontemplates.WithRef(reference), celjsontemplates.WithCelOptions([]cel.EnvOption{counter}),
+		celjsontemplates.WithoutConstantFolding())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reference["categories"].(map[string]interface{})["u"] = "User"
+	res, err := ourT.Expand(map[string]interface{}{"name": "Bob"})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if string(res) != `{"Category":"User","Label":"Hobby","Counted":"User","Name":"Bob"}` {
+		t.Errorf("Unexpected result: %s", string(res))
+	}
+}
+
+func TestExpressionMemoization(t *testing.T) {
+	calls := 0
+	counter := cel.Function("counted",
+		cel.Overload("counted_string", []*cel.Type{cel.StringType}, cel.StringType,
+			cel.UnaryBinding(func(value ref.Val) ref.Val {
+				calls++
+				return value
+			}),
+		),
+	)
+	template := `{
+		"Name": "counted(data.name)",
+		"Again": {"Name": "counted(data.name)"},
+		"Rows": "data.rows.map(r, fragment('row', r))"
+	}`
+	fragments := map[string]string{"row": `{"Row": "args[0]", "Name": "counted(data.name)"}`}
+	data := map[string]interface{}{"name": "Bob", "rows": []interface{}{1, 2}}
+	expected := `{"Name":"Bob","Again":{"Name":"Bob"},"Rows":[{"Row":1,"Name":"Bob"},{"Row":2,"Name":"Bob"}]}`
+
+	ourT, err := celjsontemplates.New(template, celjsontemplates.WithFragments(fragments),
+		celjsontemplates.WithCelOptions([]cel.EnvOption{counter}), celjsontemplates.WithExpressionMemoization())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		res, err := ourT.Expand(data)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if string(res) != expected {
+			t.Errorf("Unexpected result: %s", string(res))
+		}
+		if calls != i {
+			t.Errorf("Expected the repeated expression to be evaluated once per expansion, got %d calls", calls)
+		}
+	}
+
+	calls = 0
+	ourT, err = celjsontemplates.New(template, celjsontemplates.WithFragments(fragments),
+		celjsontemplates.WithCelOptions([]cel.EnvOption{counter}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ourT.Expand(data)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if string(res) != expected || calls != 4 {
+		t.Errorf("Unexpected result: %s after %d calls", string(res), calls)
+	}
+
+	// Specialized templates are memoized too
+	ourT, err = celjsontemplates.New(template, celjsontemplates.WithFragments(fragments),
+		celjsontemplates.WithCelOptions([]cel.EnvOption{counter}), celjsontemplates.WithExpressionMemoization())
+	if err != nil {
+		t.Fatal(err)
+	}
+	specialized, err := ourT.Specialize(map[string]interface{}{"rows": []interface{}{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls = 0
+	res, err = specialized.Expand(map[string]interface{}{"name": "Bob"})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if string(res) != expected || calls != 1 {
+		t.Errorf("Unexpected result: %s after %d calls", string(res), calls)
+	}
+}
+
+func TestExpressionMemoizationWithLoopVariables(t *testing.T) {
+	// it is both a loop variable and a fragment parameter, so the expression doesn't only read data
+	ourT, err := celjsontemplates.New(`{"rows": "data.items.fragment('row')"}`, celjsontemplates.WithFragments(map[string]string{
+		"row": `{"$params": ["it"], "v": "[1].map(it, it)[0] + it"}`,
+	}), celjsontemplates.WithExpressionMemoization())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ourT.Expand(map[string]interface{}{"items": []interface{}{10, 20, 30}})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if string(res) != `{"rows":[{"v":11},{"v":21},{"v":31}]}` {
+		t.Errorf("Unexpected result: %s", string(res))
+	}
+}
+
+func TestSharedExpressionsAreChecked(t *testing.T) {
+	_, err := celjsontemplates.New(`{"$let": {"it": "1"}, "v": "[1].map(it, it)[0] + it"}`, celjsontemplates.WithFragments(map[string]string{
+		"row": `{"v": "[1].map(it, it)[0] + it"}`,
+	}))
+	if err == nil || !strings.Contains(err.Error(), "undeclared reference to 'it'") {
+		t.Errorf("Expected a compile error for the fragment, got: %v", err)
+	}
+}
+
+func TestSpecialize(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"$require": {"data.tenant.active": "tenant must be active", "size(data.items) > 0": "order must have items"},
+		"tenant": "data.tenant.name",
+		"greeting": "data.tenant.prefix + ' ' + data.name",
+		"rows": "data.items.fragment('row', data.tenant.rate)"
+	}`, celjsontemplates.WithFragments(map[string]string{
+		"row": `{"value": "args[0] * args[1]", "tenant": "data.tenant.name"}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant := map[string]interface{}{"name": "Acme", "prefix": "Hello", "active": true, "rate": 2}
+	specialized, err := ourT.Specialize(map[string]interface{}{"tenant": tenant})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only what depends on the rest of the data is left
+	var residual []string
+	for _, reference := range specialized.References() {
+		residual = append(residual, reference.Template+" "+reference.Path)
+	}
+	expected := []string{
+		"#/$require/size(data.items) > 0 data.items",
+		"#/greeting data.name",
+		"#/rows data.items",
+		"#/rows data.tenant.rate",
+	}
+	if strings.Join(residual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected references:\n%s", strings.Join(residual, "\n"))
+	}
+
+	res, err := specialized.Expand(map[string]interface{}{"name": "Bob", "items": []interface{}{1, 2}})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if string(res) != `{"tenant":"Acme","greeting":"Hello Bob","rows":[{"value":2,"tenant":"Acme"},{"value":4,"tenant":"Acme"}]}` {
+		t.Errorf("Unexpected result: %s", string(res))
+	}
+
+	_, err = specialized.Expand(map[string]interface{}{"name": "Bob", "items": []interface{}{}})
+	if err == nil || err.Error() != "data doesn't meet the template requirements: order must have items" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// The original template is unchanged
+	res, err = ourT.Expand(map[string]interface{}{"name": "Bob", "items": []interface{}{3}, "tenant": map[string]interface{}{"name": "Other", "prefix": "Hi", "active": true, "rate": 1}})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if string(res) != `{"tenant":"Other","greeting":"Hi Bob","rows":[{"value":3,"tenant":"Other"}]}` {
+		t.Errorf("Unexpected result: %s", string(res))
+	}
+}
+
+func TestSpecializeWithoutConstantFolding(t *testing.T) {
+	reference := map[string]interface{}{"v": "old"}
+	ourT, err := celjsontemplates.New(`{"v": "ref.v", "name": "data.name"}`, celjsontemplates.WithRef(reference), celjsontemplates.WithoutConstantFolding())
+	if err != nil {
+		t.Fatal(err)
+	}
+	specialized, err := ourT.Specialize(map[string]interface{}{"name": "Bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes to the reference data are still seen by the specialized template
+	reference["v"] = "new"
+	res, err := specialized.Expand(map[string]interface{}{})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if string(res) != `{"v":"new","name":"Bob"}` {
+		t.Errorf("Unexpected result: %s", string(res))
+	}
+}
+
+func TestSpecializeWithCelFunctions(t *testing.T) {
+	calls := 0
+	next := cel.Function("next",
+		cel.Overload("next_dyn", []*cel.Type{cel.DynType}, cel.IntType,
+			cel.UnaryBinding(func(value ref.Val) ref.Val {
+				calls++
+				return types.Int(calls)
+			}),
+		),
+	)
+	ourT, err := celjsontemplates.New(`{"id": "next(data.tenant)", "tenant": "data.tenant"}`, celjsontemplates.WithCelOptions([]cel.EnvOption{next}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	specialized, err := ourT.Specialize(map[string]interface{}{"tenant": "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{`{"id":1,"tenant":"acme"}`, `{"id":2,"tenant":"acme"}`} {
+		res, err := specialized.Expand(map[string]interface{}{})
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if string(res) != expected {
+			t.Errorf("Unexpected result: %s", string(res))
+		}
+	}
+}
+
 func TestExpandWithExtraCelFunctions(t *testing.T) {
 	ourT, err := celjsontemplates.New(referenceTemplate, celjsontemplates.WithFragments(map[string]string{
 		"frag2": `{"fragtest": "'Testing'", "age": 20, "t1": "args[0].list1", "t2": "args[0].list1[1]","t3": "args[0].list1.slice(1,2)", "directlist": "args[0].complexList[1]", "directdeeplist": "args[0].complexList[1].deepList[2]","alist": "args[0].complexList.slice(1,2)", "blist": "args[0].complexList"}`,
@@ -375,7 +1799,7 @@ func TestExpandWithExtraCelFunctions(t *testing.T) {
 
 	resStr := string(res)
 
-	if !strings.EqualFold(resStr, `{"test":"avalue","sub1":88,"sub2":{"name":"a test name","age":44},"sub3":[1,2,3,40],"sub4":[{"first":40},{"second":3}],"stringtest":"lit","fragtest2":{"fragtest":"Testing","age":20,"t1":[1,2,3,4,5,6,7,8,9],"t2":2,"t3":[2],"directlist":{"deepList":[1,2,3,4,5],"name":"name2","value":"value2"},"directdeeplist":3,"alist":[{"Adapter":{}}],"blist":[{"deepList":[1,2,3,4,5],"name":"name1","value":"value1"},{"deepList":[1,2,3,4,5],"name":"name2","value":"value2"},{"deepList":[1,2,3,4,5],"name":"name3","value":"value3"}]}}`) {
+	if !strings.EqualFold(resStr, `{"test":"avalue","sub1":88,"sub2":{"name":"a test name","age":44},"sub3":[1,2,3,40],"sub4":[{"first":40},{"second":3}],"stringtest":"lit","fragtest2":{"fragtest":"Testing","age":20,"t1":[1,2,3,4,5,6,7,8,9],"t2":2,"t3":[2],"directlist":{"deepList":[1,2,3,4,5],"name":"name2","value":"value2"},"directdeeplist":3,"alist":[{"deepList":[1,2,3,4,5],"name":"name2","value":"value2"}],"blist":[{"deepList":[1,2,3,4,5],"name":"name1","value":"value1"},{"deepList":[1,2,3,4,5],"name":"name2","value":"value2"},{"deepList":[1,2,3,4,5],"name":"name3","value":"value3"}]}}`) {
 		t.Errorf("Missing value 1 in output: %s\n", string(res))
 	}
 }
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"reflect"
 
-	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/common/types"
 	"github.com/google/cel-go/common/types/ref"
 	"github.com/google/cel-go/common/types/traits"
@@ -13,135 +12,152 @@ import (
 
 // Wraps an OrderedMap in an OrderedCelMap so that it can be used inside CEL
 func wrapOrderedCelMap(ourMap *orderedmap.OrderedMap[string, interface{}]) *orderedCelMap {
-	// mapper := types.NewDynamicMap(orderedCelMapCustomTypeAdapter{}, ourMap)
-
 	return &orderedCelMap{m: ourMap}
 }
 
+// orderedCelMap exposes an OrderedMap (such as the output of a fragment) to CEL as a map.
+// It behaves like any other CEL map, while keeping the key order for the template output.
 type orderedCelMap struct {
-	// ref.TypeAdapter
 	m *orderedmap.OrderedMap[string, interface{}]
-	// traits.Mapper
-	// traits.Receiver
 }
 
 var (
-	orderedCelMapType = cel.ObjectType("OrderedCelMap",
-		traits.ContainerType,
-		traits.IndexerType,
-		traits.IterableType,
-		traits.SizerType,
-		traits.ReceiverType)
-
 	orderedCelMapAdapter = orderedCelMapCustomTypeAdapter{}
-)
-
-func (u *orderedCelMap) TypeName() string {
-	return orderedCelMapType.TypeName()
-}
 
-func (u orderedCelMap) Type() ref.Type {
-	return orderedCelMapType
-}
-
-func (u *orderedCelMap) HasTrait(trait int) bool {
-	return orderedCelMapType.HasTrait(trait)
-}
+	orderedMapReflectType = reflect.TypeOf(&orderedmap.OrderedMap[string, interface{}]{})
+)
 
-func (u orderedCelMap) Receive(function string, overload string, args []ref.Val) ref.Val {
-	// if function == "Add" {
-	// 	return types.Int(t.Add())
-	// } else if function == "Subtract" {
-	// 	return types.Int(t.Subtract())
-	// }
-	return types.ValOrErr(orderedCelMapType, "no such function - %s", function)
-}
+// Check that we implement the CEL map interface
+var _ traits.Mapper = &orderedCelMap{}
 
 // ConvertToNative implements ref.Val.ConvertToNative.
-func (u orderedCelMap) ConvertToNative(typeDesc reflect.Type) (any, error) {
-	return nil, fmt.Errorf("type conversion not supported for 'type'")
+func (u *orderedCelMap) ConvertToNative(typeDesc reflect.Type) (any, error) {
+	// Keep the ordered map where possible so that key order is retained
+	if typeDesc == orderedMapReflectType || (typeDesc.Kind() == reflect.Interface && orderedMapReflectType.Implements(typeDesc)) {
+		return u.m, nil
+	}
+
+	// Otherwise convert via a plain Go map
+	return types.DefaultTypeAdapter.NativeToValue(orderedMapToNative(u.m)).ConvertToNative(typeDesc)
 }
 
 // ConvertToType implements ref.Val.ConvertToType.
-func (u orderedCelMap) ConvertToType(typeVal ref.Type) ref.Val {
+func (u *orderedCelMap) ConvertToType(typeVal ref.Type) ref.Val {
 	switch typeVal {
-	case orderedCelMapType:
-		return orderedCelMapType
-	case types.StringType:
-		return types.String(u.TypeName())
+	case types.MapType:
+		return u
+	case types.TypeType:
+		return types.MapType
 	}
-	return types.NewErr("type conversion error from '%s' to '%s'", orderedCelMapType, typeVal)
+	return types.NewErr("type conversion error from '%s' to '%s'", types.MapType, typeVal)
 }
 
-func (u orderedCelMap) Equal(other ref.Val) ref.Val {
-	o, ok := other.Value().(orderedCelMap)
-	if ok {
-		if o == u {
-			return types.Bool(true)
-		} else {
-			return types.Bool(false)
+// Equal implements ref.Val.Equal using CEL map equality - the key order is ignored.
+func (u *orderedCelMap) Equal(other ref.Val) ref.Val {
+	otherMap, ok := other.(traits.Mapper)
+	if !ok {
+		return types.False
+	}
+	if otherMap.Size() != u.Size() {
+		return types.False
+	}
+	for pair := u.m.Oldest(); pair != nil; pair = pair.Next() {
+		otherVal, found := otherMap.Find(types.String(pair.Key))
+		if !found {
+			return types.False
+		}
+		eq := u.NativeToValue(pair.Value).Equal(otherVal)
+		if eq != types.True {
+			return eq
 		}
-	} else {
-		return types.ValOrErr(other, "%v is not of type Test", other)
 	}
+	return types.True
 }
 
-func (u *orderedCelMap) Find(key ref.Val) (ref.Val, bool) {
-	ourval, present := u.m.Get(key.Value().(string))
-
-	return u.NativeToValue(ourval), present
+// Type implements ref.Val.Type.
+func (u *orderedCelMap) Type() ref.Type {
+	return types.MapType
 }
 
-func (u orderedCelMap) Value() interface{} {
+// Value implements ref.Val.Value.
+func (u *orderedCelMap) Value() interface{} {
 	return u.m
 }
 
+// Find implements the traits.Mapper interface method.
+func (u *orderedCelMap) Find(key ref.Val) (ref.Val, bool) {
+	keyStr, ok := key.(types.String)
+	if !ok {
+		return nil, false
+	}
+	ourval, present := u.m.Get(string(keyStr))
+	if !present {
+		return nil, false
+	}
+
+	return u.NativeToValue(ourval), true
+}
+
 // Get implements the traits.Indexer interface method.
 func (u *orderedCelMap) Get(key ref.Val) ref.Val {
-	// fmt.Printf("Looking for key %v\n", key.Value())
 	v, found := u.Find(key)
 	if !found {
-		// fmt.Printf("Found value %v for key %v\n", v.Value(), key.Value())
-		return types.ValOrErr(v, "no such key: %v", key)
+		return types.ValOrErr(key, "no such key: %v", key)
 	}
 	return v
 }
 
-func (u *orderedCelMap) Contains(value ref.Val) ref.Val {
-	res, found := u.m.Get(value.Value().(string))
-	if found {
-		return u.NativeToValue(res)
-	}
-	return u.NativeToValue(nil)
+// Contains implements the traits.Container interface method.
+func (u *orderedCelMap) Contains(key ref.Val) ref.Val {
+	_, found := u.Find(key)
+	return types.Bool(found)
 }
 
-func (u *orderedCelMap) Iterator() traits.Iterator {
-
-	//for pair := node.Oldest(); pair != nil; pair = pair.Next() {
+// Size implements the traits.Sizer interface method.
+func (u *orderedCelMap) Size() ref.Val {
+	return types.Int(u.m.Len())
+}
 
+// Iterator implements the traits.Iterable interface method, returning the keys in order.
+func (u *orderedCelMap) Iterator() traits.Iterator {
 	return &mapIterator{
 		Adapter: types.DefaultTypeAdapter,
 		mapKeys: u.m.Oldest(),
 	}
 }
 
+// String implements fmt.Stringer.
+func (u *orderedCelMap) String() string {
+	return fmt.Sprint(orderedMapToNative(u.m))
+}
+
 func (u *orderedCelMap) NativeToValue(value interface{}) ref.Val {
-	val, ok := value.(orderedCelMap)
-	if ok {
-		return val
-	}
-	mapRef, ok := value.(*orderedmap.OrderedMap[string, any])
-	if ok {
-		return wrapOrderedCelMap(mapRef)
+	return orderedCelMapAdapter.NativeToValue(value)
+}
+
+// orderedMapToNative converts an OrderedMap and any nested OrderedMaps into plain Go maps
+func orderedMapToNative(m *orderedmap.OrderedMap[string, interface{}]) map[string]interface{} {
+	result := make(map[string]interface{}, m.Len())
+	for pair := m.Oldest(); pair != nil; pair = pair.Next() {
+		result[pair.Key] = orderedValueToNative(pair.Value)
 	}
-	mapval, ok := value.(orderedmap.OrderedMap[string, any])
-	if ok {
-		return wrapOrderedCelMap(&mapval)
+	return result
+}
+
+func orderedValueToNative(value interface{}) interface{} {
+	switch val := value.(type) {
+	case *orderedmap.OrderedMap[string, interface{}]:
+		return orderedMapToNative(val)
+	case *orderedCelMap:
+		return orderedMapToNative(val.m)
+	case []interface{}:
+		result := make([]interface{}, 0, len(val))
+		for _, item := range val {
+			result = append(result, orderedValueToNative(item))
+		}
+		return result
 	}
-
-	//let the default adapter handle other cases
-	return types.DefaultTypeAdapter.NativeToValue(value)
-
+	return value
 }
 
 type mapIterator struct {
@@ -193,17 +209,16 @@ func (*baseIterator) Value() any {
 type orderedCelMapCustomTypeAdapter struct{}
 
 func (o orderedCelMapCustomTypeAdapter) NativeToValue(value interface{}) ref.Val {
-	val, ok := value.(orderedCelMap)
-	if ok {
-		return val
-	}
-	mapRef, ok := value.(*orderedmap.OrderedMap[string, any])
-	if ok {
-		return wrapOrderedCelMap(mapRef)
-	}
-	mapval, ok := value.(orderedmap.OrderedMap[string, any])
-	if ok {
-		return wrapOrderedCelMap(&mapval)
+	switch val := value.(type) {
+	case *orderedmap.OrderedMap[string, any]:
+		return wrapOrderedCelMap(val)
+	case orderedmap.OrderedMap[string, any]:
+		return wrapOrderedCelMap(&val)
+	case []interface{}:
+		// Lists may hold OrderedMaps, so their items need to use this adapter
+		return types.NewDynamicList(o, val)
+	case map[string]interface{}:
+		return types.NewStringInterfaceMap(o, val)
 	}
 
 	//let the default adapter handle other cases
@@ -13,6 +13,7 @@ import (
 func main() {
 
 	var exampleDir = flag.String("dir", "examples", "Directory holding the examples")
+	var lineage = flag.String("lineage", "", "Print the lineage of the template output instead of expanding it (json or dot)")
 	flag.Parse()
 
 	if flag.Lookup("help") != nil || flag.Lookup("h") != nil {
@@ -33,6 +34,25 @@ func main() {
 		return
 	}
 
+	// Report the lineage if asked
+	switch *lineage {
+	case "":
+	case "json":
+		res, err := e.template.Lineage().Json()
+		if err != nil {
+			fmt.Printf("Error encoding lineage: %v\n", err)
+			return
+		}
+		fmt.Println(string(res))
+		return
+	case "dot":
+		fmt.Print(e.template.Lineage().Dot())
+		return
+	default:
+		fmt.Printf("Unknown lineage format %s, use json or dot\n", *lineage)
+		return
+	}
+
 	// Expand the example
 	res, err := e.template.Expand(e.input)
 	if err != nil {
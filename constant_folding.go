@@ -0,0 +1,61 @@
+package celjsontemplates
+
+import (
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/stdlib"
+)
+
+// foldableOverloads holds the overloads that always give the same result for the same arguments:
+// the CEL standard library, the optional types library and the value functions of this package.
+// Functions added with WithCelOptions aren't included as they may not, for example a counter or
+// the current time.
+var foldableOverloads = func() map[string]bool {
+	overloads := map[string]bool{
+		"omit_if_empty_V": true, "omit_if_null_V": true, "value_or_remove_V": true,
+		"optional_of": true, "optional_ofNonZeroValue": true, "optional_none": true,
+		"optional_value": true, "optional_hasValue": true, "optional_or_optional": true,
+		"optional_orValue_value": true, "select_optional_field": true,
+		"list_optindex_optional_int": true, "optional_list_optindex_optional_int": true,
+		"map_optindex_optional_value": true, "optional_map_optindex_optional_value": true,
+		"optional_list_index_int": true, "optional_map_index_value": true,
+	}
+	for _, fn := range stdlib.Functions() {
+		for _, overload := range fn.OverloadDecls() {
+			overloads[overload.ID()] = true
+		}
+	}
+	return overloads
+}()
+
+// foldConstants evaluates the expressions that only depend on the reference data, so that they
+// aren't run again for every expansion. Expressions that fail are left to fail when expanded.
+func (t *celTemplate) foldConstants() {
+	input := map[string]any{"ref": t.ref}
+	t.walkExpressions(func(location string, expr *templateExpression) {
+		for name := range freeVariables(expr.ast.NativeRep().Expr()) {
+			if name != "ref" {
+				return
+			}
+		}
+		if !callsFoldableOverloads(expr.ast) {
+			return
+		}
+
+		out, _, err := expr.program.Eval(input)
+		if err == nil {
+			expr.constant = out
+		}
+	})
+}
+
+// callsFoldableOverloads reports whether every function called by a checked expression is one of foldableOverloads
+func callsFoldableOverloads(ast *cel.Ast) bool {
+	for _, reference := range ast.NativeRep().ReferenceMap() {
+		for _, id := range reference.OverloadIDs {
+			if !foldableOverloads[id] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,314 @@
+package celjsontemplates
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+)
+
+// schemaNode is a JSON Schema converted for use with CEL
+type schemaNode struct {
+	// celType is the CEL type of values described by the schema
+	celType *cel.Type
+	// kind is the JSON Schema type of the values, empty if there isn't a single type
+	kind string
+	// properties describes the fields of an object
+	properties map[string]*schemaNode
+	// additional describes any other values of an object
+	additional *schemaNode
+	// items describes the items of an array
+	items *schemaNode
+}
+
+// schemaConverter converts a JSON Schema into CEL types, declaring struct types for objects with known properties
+type schemaConverter struct {
+	root     any
+	provider *structTypeProvider
+	// refs holds the schemas that have been converted for each $ref, so recursive schemas can be used
+	refs map[string]*schemaNode
+}
+
+// parseDataSchema converts a JSON Schema describing the input data into CEL types
+func parseDataSchema(jsonSchema []byte, provider *structTypeProvider) (*schemaNode, error) {
+	var root any
+	err := json.Unmarshal(jsonSchema, &root)
+	if err != nil {
+		return nil, fmt.Errorf("data schema: %w", err)
+	}
+
+	c := &schemaConverter{
+		root:     root,
+		provider: provider,
+		refs:     make(map[string]*schemaNode),
+	}
+
+	node := &schemaNode{}
+	c.refs["#"] = node
+	err = c.fill(root, structTypePrefix+"data", node)
+	if err != nil {
+		return nil, fmt.Errorf("data schema: %w", err)
+	}
+	if node.kind != "object" {
+		return nil, fmt.Errorf("data schema: the data must be described as an object")
+	}
+	return node, nil
+}
+
+// convert converts schema, naming any struct type after name. Schemas that use $ref share the converted node.
+func (c *schemaConverter) convert(schema any, name string) (*schemaNode, error) {
+	if schemaObj, ok := schema.(map[string]any); ok {
+		if ref, ok := schemaObj["$ref"].(string); ok {
+			return c.resolveRef(ref)
+		}
+	}
+
+	node := &schemaNode{}
+	return node, c.fill(schema, name, node)
+}
+
+// fill fills in node from schema, naming any struct type after name
+func (c *schemaConverter) fill(schema any, name string, node *schemaNode) error {
+	schemaObj, ok := schema.(map[string]any)
+	if !ok {
+		// true, false or something we don't understand
+		node.celType = cel.DynType
+		return nil
+	}
+
+	if ref, ok := schemaObj["$ref"].(string); ok {
+		refNode, err := c.resolveRef(ref)
+		if err != nil {
+			return err
+		}
+		*node = *refNode
+		return nil
+	}
+
+	kind, nullable := schemaKind(schemaObj)
+	node.kind = kind
+	node.celType = cel.DynType
+
+	switch kind {
+	case "string":
+		node.celType = nullableType(cel.StringType, nullable)
+	case "integer":
+		node.celType = nullableType(cel.IntType, nullable)
+	case "number":
+		node.celType = nullableType(cel.DoubleType, nullable)
+	case "boolean":
+		node.celType = nullableType(cel.BoolType, nullable)
+	case "null":
+		node.celType = cel.NullType
+	case "array":
+		node.items = &schemaNode{celType: cel.DynType}
+		if items, found := schemaObj["items"]; found {
+			var err error
+			node.items, err = c.convert(items, name+".item")
+			if err != nil {
+				return err
+			}
+		}
+		if !nullable {
+			node.celType = cel.ListType(node.items.typeOrDyn())
+		}
+	case "object":
+		return c.convertObject(schemaObj, name, node)
+	}
+	return nil
+}
+
+// convertObject converts an object schema. Objects that list their properties and don't allow
+// additional properties become struct types, other objects become maps.
+func (c *schemaConverter) convertObject(schemaObj map[string]any, name string, node *schemaNode) error {
+	properties, _ := schemaObj["properties"].(map[string]any)
+	additional, hasAdditional := schemaObj["additionalProperties"]
+	if additional == false {
+		hasAdditional = false
+	}
+
+	isStruct := len(properties) > 0 && !hasAdditional
+	for property := range properties {
+		if !celIdentifier.MatchString(property) {
+			isStruct = false
+		}
+	}
+
+	if isStruct {
+		// Declare the type first so that recursive references can use it
+		node.celType = cel.ObjectType(name)
+	}
+
+	node.properties = make(map[string]*schemaNode, len(properties))
+	for property, propertySchema := range properties {
+		propertyNode, err := c.convert(propertySchema, name+"."+property)
+		if err != nil {
+			return fmt.Errorf("%s: %w", property, err)
+		}
+		node.properties[property] = propertyNode
+	}
+
+	if isStruct {
+		fields := make(map[string]*cel.Type, len(node.properties))
+		for property, propertyNode := range node.properties {
+			fields[property] = propertyNode.typeOrDyn()
+		}
+		c.provider.addStruct(name, fields)
+		return nil
+	}
+
+	node.additional = &schemaNode{celType: cel.DynType}
+	if hasAdditional {
+		var err error
+		node.additional, err = c.convert(additional, name+".value")
+		if err != nil {
+			return err
+		}
+	}
+	node.celType = cel.MapType(cel.StringType, node.additional.typeOrDyn())
+	if len(node.properties) > 0 {
+		// The properties may have different types
+		node.celType = cel.MapType(cel.StringType, cel.DynType)
+	}
+	return nil
+}
+
+// resolveRef converts the schema referred to by a local $ref such as #/$defs/address
+func (c *schemaConverter) resolveRef(ref string) (*schemaNode, error) {
+	if node, found := c.refs[ref]; found {
+		return node, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("only local references are supported, got %s", ref)
+	}
+
+	var target any = c.root
+	segments := strings.Split(strings.TrimPrefix(ref, "#/"), "/")
+	for _, segment := range segments {
+		segment = strings.ReplaceAll(strings.ReplaceAll(segment, "~1", "/"), "~0", "~")
+		obj, ok := target.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unable to resolve reference %s", ref)
+		}
+		target, ok = obj[segment]
+		if !ok {
+			return nil, fmt.Errorf("unable to resolve reference %s", ref)
+		}
+	}
+
+	node := &schemaNode{}
+	c.refs[ref] = node
+	err := c.fill(target, structTypePrefix+"defs."+segments[len(segments)-1], node)
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// schemaKind returns the JSON Schema type of a schema and whether null is also allowed
+func schemaKind(schemaObj map[string]any) (string, bool) {
+	switch kind := schemaObj["type"].(type) {
+	case string:
+		return kind, false
+	case []any:
+		var kinds []string
+		nullable := false
+		for _, k := range kind {
+			if k == "null" {
+				nullable = true
+			} else if kStr, ok := k.(string); ok {
+				kinds = append(kinds, kStr)
+			}
+		}
+		if len(kinds) == 1 {
+			return kinds[0], nullable
+		}
+		if len(kinds) == 0 && nullable {
+			return "null", false
+		}
+		return "", false
+	}
+
+	// Without a type the keywords that are used show what is expected
+	if _, found := schemaObj["properties"]; found {
+		return "object", false
+	}
+	if _, found := schemaObj["items"]; found {
+		return "array", false
+	}
+	return "", false
+}
+
+// typeOrDyn returns the CEL type of the node, or dyn if the node is still being converted
+func (n *schemaNode) typeOrDyn() *cel.Type {
+	if n.celType == nil {
+		return cel.DynType
+	}
+	return n.celType
+}
+
+// nullableType allows null to be used with a primitive type
+func nullableType(celType *cel.Type, nullable bool) *cel.Type {
+	if nullable {
+		return cel.NullableType(celType)
+	}
+	return celType
+}
+
+// coerce converts the numbers in value to the types given by the schema. JSON doesn't distinguish
+// between integers and floating point numbers, while CEL doesn't mix them in arithmetic.
+func (n *schemaNode) coerce(value any) any {
+	if n == nil {
+		return value
+	}
+
+	switch n.kind {
+	case "integer":
+		if f, ok := value.(float64); ok && f == math.Trunc(f) && math.Abs(f) <= 1<<53 {
+			return int64(f)
+		}
+	case "number":
+		switch v := value.(type) {
+		case int:
+			return float64(v)
+		case int32:
+			return float64(v)
+		case int64:
+			return float64(v)
+		}
+	case "array":
+		if list, ok := value.([]any); ok {
+			result := make([]any, 0, len(list))
+			for _, item := range list {
+				result = append(result, n.items.coerce(item))
+			}
+			return result
+		}
+	case "object":
+		switch obj := value.(type) {
+		case map[string]any:
+			result := make(map[string]any, len(obj))
+			for key, item := range obj {
+				result[key] = n.propertySchema(key).coerce(item)
+			}
+			return result
+		case *orderedmap.OrderedMap[string, any]:
+			result := orderedmap.New[string, any]()
+			for pair := obj.Oldest(); pair != nil; pair = pair.Next() {
+				result.Set(pair.Key, n.propertySchema(pair.Key).coerce(pair.Value))
+			}
+			return result
+		}
+	}
+	return value
+}
+
+func (n *schemaNode) propertySchema(key string) *schemaNode {
+	if property, found := n.properties[key]; found {
+		return property
+	}
+	return n.additional
+}
@@ -0,0 +1,223 @@
+package celjsontemplates
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/parser"
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+)
+
+// expansionVariable is the hidden CEL variable that carries the expansion state.
+// Macros add it as an argument to the functions that need access to it.
+const expansionVariable = "__expansion__"
+
+var expansionType = cel.OpaqueType("celjsontemplates.Expansion")
+
+// expansion holds the state of a single call to Expand.
+// It is made available to CEL functions through the expansionVariable, so a Template can be
+// expanded concurrently.
+type expansion struct {
+	// data holds the input data passed to Expand
+	data any
+	// fragments holds the compiled fragments of the template being expanded
+	fragments map[string]*compiledFragment
+	// fragmentStack holds the names of the fragments currently being expanded, outermost first
+	fragmentStack []string
+	// fragmentScopes holds the activations of the fragments currently being expanded, outermost first
+	fragmentScopes []map[string]any
+	// root holds the top level template output
+	root *orderedmap.OrderedMap[string, any]
+	// path holds the JSON path segments of the value currently being expanded
+	path []string
+	// pointer holds the JSON pointer segments of the value currently being expanded
+	pointer []string
+	// templateDocument names the fragment being expanded, empty for the template itself
+	templateDocument string
+	// templatePointer holds the JSON pointer segments of the template value currently being expanded
+	templatePointer []string
+	// sources maps the JSON pointer of output values to the template values that produced them.
+	// It is only recorded when the output is checked against a schema.
+	sources map[string]string
+	// warnings holds the warnings raised so far
+	warnings []Warning
+	// memo holds the results of the expressions that only read data and ref, when memoization is enabled
+	memo map[string]memoResult
+}
+
+// memoResult is the result of evaluating an expression
+type memoResult struct {
+	value ref.Val
+	err   error
+}
+
+func newExpansion(data any) *expansion {
+	return &expansion{data: data}
+}
+
+// parentScope returns the variables of the fragment that is currently being expanded, for use as
+// the parent of a fragment it calls. Calls from the template itself have an empty parent.
+func (e *expansion) parentScope() map[string]any {
+	parent := make(map[string]any)
+	if len(e.fragmentScopes) == 0 {
+		return parent
+	}
+
+	for name, value := range e.fragmentScopes[len(e.fragmentScopes)-1] {
+		switch name {
+		case "data", "ref", expansionVariable:
+			// These are the same for every fragment
+		default:
+			parent[name] = value
+		}
+	}
+	return parent
+}
+
+// pushKey records that the value of an object key is being expanded
+func (e *expansion) pushKey(key string) {
+	if celIdentifier.MatchString(key) {
+		e.path = append(e.path, "."+key)
+	} else {
+		e.path = append(e.path, "["+strconv.Quote(key)+"]")
+	}
+	e.pointer = append(e.pointer, escapePointerSegment(key))
+}
+
+// pushIndex records that a list item is being expanded
+func (e *expansion) pushIndex(index int) {
+	e.path = append(e.path, "["+strconv.Itoa(index)+"]")
+	e.pointer = append(e.pointer, strconv.Itoa(index))
+}
+
+func (e *expansion) popPath() {
+	e.path = e.path[:len(e.path)-1]
+	e.pointer = e.pointer[:len(e.pointer)-1]
+}
+
+// currentPath returns the JSON path of the output value being expanded, e.g. $.items[0].name
+func (e *expansion) currentPath() string {
+	return "$" + strings.Join(e.path, "")
+}
+
+// currentPointer returns the JSON pointer of the output value being expanded, e.g. /items/0/name
+func (e *expansion) currentPointer() string {
+	return joinPointer(e.pointer)
+}
+
+// pushTemplateKey records the template key of the value being expanded, e.g. "name?"
+func (e *expansion) pushTemplateKey(key string) {
+	e.templatePointer = append(e.templatePointer, escapePointerSegment(key))
+}
+
+// pushTemplateIndex records the position in the template of the list item being expanded
+func (e *expansion) pushTemplateIndex(index int) {
+	e.templatePointer = append(e.templatePointer, strconv.Itoa(index))
+}
+
+func (e *expansion) popTemplatePath() {
+	e.templatePointer = e.templatePointer[:len(e.templatePointer)-1]
+}
+
+// enterTemplateDocument starts recording template locations within a fragment, returning a
+// function that goes back to the caller's location
+func (e *expansion) enterTemplateDocument(name string) func() {
+	document, pointer := e.templateDocument, e.templatePointer
+	e.templateDocument, e.templatePointer = name, nil
+	return func() {
+		e.templateDocument, e.templatePointer = document, pointer
+	}
+}
+
+// templateLocation returns the template value being expanded as a JSON pointer within the
+// template, prefixed with the fragment name when in a fragment, e.g. #/items/0 or row#/total
+func (e *expansion) templateLocation() string {
+	return e.templateDocument + "#" + joinPointer(e.templatePointer)
+}
+
+// recordSource notes which template value produced the output value being expanded
+func (e *expansion) recordSource() {
+	if e.sources == nil {
+		return
+	}
+	pointer := e.currentPointer()
+	if _, found := e.sources[pointer]; found {
+		// An earlier value at this position was left out, so forget where its contents came from
+		for existing := range e.sources {
+			if strings.HasPrefix(existing, pointer+"/") {
+				delete(e.sources, existing)
+			}
+		}
+	}
+	e.sources[pointer] = e.templateLocation()
+}
+
+// sourceOf returns the template value that produced the output value at pointer. Values that come
+// from the data or are built by CEL are attributed to the closest template value containing them.
+func (e *expansion) sourceOf(pointer string) string {
+	for {
+		if source, found := e.sources[pointer]; found {
+			return source
+		}
+		if pointer == "" {
+			return ""
+		}
+		pointer = pointer[:strings.LastIndex(pointer, "/")]
+	}
+}
+
+// escapePointerSegment escapes a key for use in a JSON pointer (RFC 6901)
+func escapePointerSegment(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+func joinPointer(segments []string) string {
+	if len(segments) == 0 {
+		return ""
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// expansionMacro rewrites calls to the global function name so that the expansion state is passed as the first argument
+func expansionMacro(name string) cel.EnvOption {
+	return cel.Macros(
+		cel.GlobalVarArgMacro(name, func(eh parser.ExprHelper, target ast.Expr, args []ast.Expr) (ast.Expr, *common.Error) {
+			if len(args) == 0 {
+				return nil, nil
+			}
+			return eh.NewCall(name, append([]ast.Expr{eh.NewIdent(expansionVariable)}, args...)...), nil
+		}),
+	)
+}
+
+// ConvertToNative implements ref.Val.ConvertToNative.
+func (e *expansion) ConvertToNative(typeDesc reflect.Type) (any, error) {
+	return nil, errors.New("type conversion not supported for expansion state")
+}
+
+// ConvertToType implements ref.Val.ConvertToType.
+func (e *expansion) ConvertToType(typeVal ref.Type) ref.Val {
+	return types.NewErr("type conversion not supported for expansion state")
+}
+
+// Equal implements ref.Val.Equal.
+func (e *expansion) Equal(other ref.Val) ref.Val {
+	return types.Bool(e == other)
+}
+
+// Type implements ref.Val.Type.
+func (e *expansion) Type() ref.Type {
+	return expansionType
+}
+
+// Value implements ref.Val.Value.
+func (e *expansion) Value() any {
+	return e
+}
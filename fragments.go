@@ -0,0 +1,397 @@
+package celjsontemplates
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/buger/jsonparser"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	"github.com/google/cel-go/parser"
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+)
+
+// defaultMaxFragmentDepth is the default limit on how deeply fragments can call other fragments
+const defaultMaxFragmentDepth = 32
+
+var (
+	// ErrFragmentNotFound is returned when a template refers to a fragment that hasn't been registered
+	ErrFragmentNotFound = errors.New("fragment not found")
+	// ErrFragmentDepthExceeded is returned when fragments call each other more deeply than allowed by WithMaxFragmentDepth
+	ErrFragmentDepthExceeded = errors.New("maximum fragment depth exceeded")
+	// ErrFragmentNotIterable is returned when a list based fragment is called on a value that isn't a list or map
+	ErrFragmentNotIterable = errors.New("fragment can only be called on a list or map")
+)
+
+// FragmentError reports a failure while expanding a fragment.
+// Stack holds the chain of fragment calls that led to the failure, outermost first.
+type FragmentError struct {
+	Stack []string
+	Err   error
+}
+
+func (e *FragmentError) Error() string {
+	return fmt.Sprintf("fragment %s: %v", strings.Join(e.Stack, " -> "), e.Err)
+}
+
+func (e *FragmentError) Unwrap() error {
+	return e.Err
+}
+
+// newFragmentError wraps err with the current fragment call stack, unless it already carries one.
+// A TemplateFailure is passed on unchanged as it already reports where it was raised.
+func newFragmentError(ex *expansion, err error) ref.Val {
+	var fragmentErr *FragmentError
+	var failure *TemplateFailure
+	if errors.As(err, &fragmentErr) || errors.As(err, &failure) {
+		return types.WrapErr(err)
+	}
+	stack := make([]string, len(ex.fragmentStack))
+	copy(stack, ex.fragmentStack)
+	return types.WrapErr(&FragmentError{Stack: stack, Err: err})
+}
+
+// fragmentParamsKey is the fragment header that declares the names of the fragment parameters
+const fragmentParamsKey = "$params"
+
+// fragmentVariables are the variables that are always available to fragments and so can't be used as parameter names
+var fragmentVariables = []string{"args", "ref", "data", "parent", "index", "first", "last", "length", expansionVariable}
+
+var celIdentifier = regexp.MustCompile(`^[_a-zA-Z][_a-zA-Z0-9]*$`)
+
+// compiledFragment holds a fragment ready for expansion
+type compiledFragment struct {
+	// params holds the parameter names declared in the fragment header
+	params []string
+	// body holds the compiled fragment template
+	body *orderedmap.OrderedMap[string, interface{}]
+}
+
+// compileFragment compiles a fragment, declaring any parameters listed in the $params header as variables
+func compileFragment(env *templateEnv, name string, fragment []byte, scope *outputScope) (*compiledFragment, error) {
+	cf := &compiledFragment{}
+
+	if _, _, _, err := jsonparser.Get(fragment, requireKey); err == nil {
+		return nil, fmt.Errorf("fragment %s: %s is only allowed at the top level of the template", name, requireKey)
+	}
+
+	paramsValue, dataType, _, err := jsonparser.Get(fragment, fragmentParamsKey)
+	if err == nil {
+		if dataType != jsonparser.Array {
+			return nil, fmt.Errorf("fragment %s: %s must be a list of parameter names", name, fragmentParamsKey)
+		}
+		var paramErr error
+		jsonparser.ArrayEach(paramsValue, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+			param := string(value)
+			switch {
+			case dataType != jsonparser.String || !celIdentifier.MatchString(param):
+				paramErr = fmt.Errorf("fragment %s: invalid parameter name %s", name, value)
+			case containsString(fragmentVariables, param) || containsString(cf.params, param):
+				paramErr = fmt.Errorf("fragment %s: parameter name %s is already in use", name, param)
+			}
+			cf.params = append(cf.params, param)
+		})
+		if paramErr != nil {
+			return nil, paramErr
+		}
+
+		var paramVariables []cel.EnvOption
+		for _, param := range cf.params {
+			paramVariables = append(paramVariables, cel.Variable(param, cel.DynType))
+		}
+		env, err = env.extend(paramVariables...)
+		if err != nil {
+			return nil, err
+		}
+		fragment = jsonparser.Delete(fragment, fragmentParamsKey)
+	}
+
+	cf.body, err = parseTemplate(env, fragment, scope)
+	if err != nil {
+		return nil, err
+	}
+	return cf, nil
+}
+
+// bindArguments builds the activation for a fragment from the positional and named arguments.
+// Positional arguments are available through args and are also bound to the declared parameters in order.
+func (cf *compiledFragment) bindArguments(positional []interface{}, named map[string]interface{}) (map[string]interface{}, error) {
+	input := map[string]interface{}{
+		"args": positional,
+	}
+
+	for i, param := range cf.params {
+		if i < len(positional) {
+			input[param] = positional[i]
+		} else {
+			input[param] = nil
+		}
+	}
+
+	for param, value := range named {
+		if !containsString(cf.params, param) {
+			return nil, fmt.Errorf("unknown fragment parameter %s", param)
+		}
+		input[param] = value
+	}
+
+	return input, nil
+}
+
+// fragmentArguments converts the list or map of arguments passed to fragment into positional or named arguments.
+// A map passed to a fragment that doesn't declare any parameters is its only positional argument.
+func (cf *compiledFragment) fragmentArguments(args ref.Val) ([]interface{}, map[string]interface{}, error) {
+	switch val := args.(type) {
+	case traits.Mapper:
+		if len(cf.params) == 0 {
+			return []interface{}{val.Value()}, nil, nil
+		}
+		named := make(map[string]interface{})
+		for it := val.Iterator(); it.HasNext() == types.True; {
+			key := it.Next()
+			param, ok := key.Value().(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("fragment parameter names must be strings, got %v", key.Value())
+			}
+			named[param] = val.Get(key).Value()
+		}
+		return nil, named, nil
+	case traits.Lister:
+		var positional []interface{}
+		for it := val.Iterator(); it.HasNext() == types.True; {
+			positional = append(positional, it.Next().Value())
+		}
+		return positional, nil, nil
+	}
+	return nil, nil, fmt.Errorf("unexpected fragment arguments of type %s", args.Type().TypeName())
+}
+
+// fragmentItems returns the arguments for each call of a list based fragment.
+// Lists produce one argument per item, maps produce the key and value for each entry. Maps that
+// don't keep their order (such as Go maps) are iterated in key order so the output is stable.
+func fragmentItems(receiver ref.Val) ([][]interface{}, error) {
+	switch val := receiver.(type) {
+	case traits.Mapper:
+		var keys []ref.Val
+		for it := val.Iterator(); it.HasNext() == types.True; {
+			keys = append(keys, it.Next())
+		}
+		if _, ordered := receiver.(*orderedCelMap); !ordered {
+			sort.SliceStable(keys, func(i, j int) bool {
+				cmp, ok := keys[i].(traits.Comparer)
+				return ok && cmp.Compare(keys[j]) == types.IntNegOne
+			})
+		}
+
+		items := make([][]interface{}, 0, len(keys))
+		for _, key := range keys {
+			items = append(items, []interface{}{key.Value(), val.Get(key).Value()})
+		}
+		return items, nil
+	case traits.Lister:
+		var items [][]interface{}
+		for it := val.Iterator(); it.HasNext() == types.True; {
+			items = append(items, []interface{}{it.Next().Value()})
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("%w, got %s", ErrFragmentNotIterable, receiver.Type().TypeName())
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// getFragmentMacros rewrites calls to fragment so that the expansion state is passed as the first argument.
+// Any arguments after the fragment name are gathered into a list, unless the only argument is a map literal
+// with string keys in which case it holds the named arguments for the fragment.
+func getFragmentMacros() cel.EnvOption {
+	fragmentArgs := func(eh parser.ExprHelper, args []ast.Expr) []ast.Expr {
+		callArgs := []ast.Expr{eh.NewIdent(expansionVariable), args[0]}
+		if len(args) == 2 && isNamedArguments(args[1]) {
+			return append(callArgs, args[1])
+		}
+		return append(callArgs, eh.NewList(args[1:]...))
+	}
+
+	return cel.Macros(
+		cel.GlobalVarArgMacro("fragment", func(eh parser.ExprHelper, target ast.Expr, args []ast.Expr) (ast.Expr, *common.Error) {
+			if len(args) == 0 {
+				return nil, nil
+			}
+			return eh.NewCall("fragment", fragmentArgs(eh, args)...), nil
+		}),
+		cel.ReceiverVarArgMacro("fragment", func(eh parser.ExprHelper, target ast.Expr, args []ast.Expr) (ast.Expr, *common.Error) {
+			if len(args) == 0 {
+				return nil, nil
+			}
+			return eh.NewMemberCall("fragment", target, fragmentArgs(eh, args)...), nil
+		}),
+	)
+}
+
+// isNamedArguments reports whether a fragment argument is a map literal whose keys are all strings
+func isNamedArguments(arg ast.Expr) bool {
+	if arg.Kind() != ast.MapKind {
+		return false
+	}
+	for _, entry := range arg.AsMap().Entries() {
+		key := entry.AsMapEntry().Key()
+		if key.Kind() != ast.LiteralKind {
+			return false
+		}
+		if _, ok := key.AsLiteral().(types.String); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// enterFragment looks up the named fragment and pushes it onto the fragment call stack.
+// The caller must call leaveFragment once the fragment has been expanded.
+func (t *celTemplate) enterFragment(ex *expansion, name ref.Val) (*compiledFragment, ref.Val) {
+	fragmentName, ok := name.Value().(string)
+	if !ok {
+		return nil, types.WrapErr(errors.New("the fragment name must be a string"))
+	}
+
+	ex.fragmentStack = append(ex.fragmentStack, fragmentName)
+
+	cf, ok := ex.fragments[fragmentName]
+	if !ok {
+		errVal := newFragmentError(ex, ErrFragmentNotFound)
+		t.leaveFragment(ex)
+		return nil, errVal
+	}
+
+	if len(ex.fragmentStack) > t.maxFragmentDepth {
+		errVal := newFragmentError(ex, fmt.Errorf("%w (limit %d)", ErrFragmentDepthExceeded, t.maxFragmentDepth))
+		t.leaveFragment(ex)
+		return nil, errVal
+	}
+
+	return cf, nil
+}
+
+func (t *celTemplate) leaveFragment(ex *expansion) {
+	ex.fragmentStack = ex.fragmentStack[:len(ex.fragmentStack)-1]
+}
+
+// expandFragment expands a fragment for a single call or list item.
+// Calls that aren't list based are treated as a list of one item.
+func (t *celTemplate) expandFragment(ex *expansion, cf *compiledFragment, positional []interface{}, named map[string]interface{}, index int, length int) (*orderedmap.OrderedMap[string, interface{}], error) {
+	input, err := cf.bindArguments(positional, named)
+	if err != nil {
+		return nil, err
+	}
+
+	input[expansionVariable] = ex
+	input["data"] = ex.data
+	input["parent"] = ex.parentScope()
+	input["index"] = index
+	input["first"] = index == 0
+	input["last"] = index == length-1
+	input["length"] = length
+
+	if t.ref != nil {
+		input["ref"] = t.ref
+	}
+
+	ex.fragmentScopes = append(ex.fragmentScopes, input)
+	defer func() {
+		ex.fragmentScopes = ex.fragmentScopes[:len(ex.fragmentScopes)-1]
+	}()
+	defer ex.enterTemplateDocument(ex.fragmentStack[len(ex.fragmentStack)-1])()
+
+	return t.expandNode(input, cf.body)
+}
+
+func (t *celTemplate) getFragmentsFunction() cel.EnvOption {
+	ourBinding := cel.FunctionBinding(func(args ...ref.Val) ref.Val {
+		// The expansion state is always first, followed by the fragment name and the fragment arguments
+		ex := args[0].(*expansion)
+		cf, errVal := t.enterFragment(ex, args[1])
+		if errVal != nil {
+			return errVal
+		}
+		defer t.leaveFragment(ex)
+
+		positional, named, err := cf.fragmentArguments(args[2])
+		if err != nil {
+			return newFragmentError(ex, err)
+		}
+
+		outputData, err := t.expandFragment(ex, cf, positional, named, 0, 1)
+
+		if err != nil {
+			return newFragmentError(ex, err)
+		}
+
+		return wrapOrderedCelMap(outputData)
+	})
+
+	listBasedBinding := cel.FunctionBinding(func(args ...ref.Val) ref.Val {
+		// The list or map comes first, then the expansion state, the fragment name and the fragment arguments
+		ex := args[1].(*expansion)
+		cf, errVal := t.enterFragment(ex, args[2])
+		if errVal != nil {
+			return errVal
+		}
+		defer t.leaveFragment(ex)
+
+		extraArgs, named, err := cf.fragmentArguments(args[3])
+		if err != nil {
+			return newFragmentError(ex, err)
+		}
+
+		items, err := fragmentItems(args[0])
+		if err != nil {
+			return newFragmentError(ex, err)
+		}
+
+		resultList := make([]interface{}, 0, len(items))
+		for i, item := range items {
+			// The item (or map key and value) is passed first
+			passedArgs := append(item, extraArgs...)
+			ex.pushIndex(i)
+			outputData, err := t.expandFragment(ex, cf, passedArgs, named, i, len(items))
+			ex.popPath()
+
+			if err != nil {
+				return newFragmentError(ex, err)
+			}
+
+			resultList = append(resultList, outputData)
+		}
+
+		return orderedCelMapAdapter.NativeToValue(resultList)
+	})
+
+	return cel.Function("fragment",
+		cel.Overload("fragment_expansion_string_list", []*cel.Type{expansionType, cel.StringType, cel.ListType(cel.DynType)}, cel.DynType,
+			ourBinding,
+		),
+		cel.Overload("fragment_expansion_string_map", []*cel.Type{expansionType, cel.StringType, cel.MapType(cel.StringType, cel.DynType)}, cel.DynType,
+			ourBinding,
+		),
+		// Now the list based overloads
+		cel.MemberOverload("dyn_fragment_expansion_string_list", []*cel.Type{cel.DynType, expansionType, cel.StringType, cel.ListType(cel.DynType)}, cel.DynType,
+			listBasedBinding,
+		),
+		cel.MemberOverload("dyn_fragment_expansion_string_map", []*cel.Type{cel.DynType, expansionType, cel.StringType, cel.MapType(cel.StringType, cel.DynType)}, cel.DynType,
+			listBasedBinding,
+		),
+	)
+}
@@ -2,11 +2,13 @@ module github.com/cms103/cel-json-templates
 
 go 1.20
 
-require github.com/google/cel-go v0.18.2
+require (
+	github.com/buger/jsonparser v1.1.1
+	github.com/google/cel-go v0.18.2
+)
 
 require (
 	github.com/bahlo/generic-list-go v0.2.0 // indirect
-	github.com/buger/jsonparser v1.1.1 // indirect
 	github.com/mailru/easyjson v0.7.7 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -19,5 +21,5 @@ require (
 	golang.org/x/text v0.9.0 // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20230803162519-f966b187b2e5 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20230803162519-f966b187b2e5 // indirect
-	google.golang.org/protobuf v1.31.0 // indirect
+	google.golang.org/protobuf v1.31.0
 )
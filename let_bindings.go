@@ -0,0 +1,88 @@
+package celjsontemplates
+
+import (
+	"fmt"
+
+	"github.com/buger/jsonparser"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+)
+
+// letKey is the object key that declares variables for the rest of the object
+const letKey = "$let"
+
+// reservedLetNames are the variables that are always available to templates and so can't be redeclared by $let
+var reservedLetNames = []string{"data", "ref", selfVariable, rootVariable, expansionVariable}
+
+// letBindings holds the variables declared by a $let block, in declaration order
+type letBindings struct {
+	names  []string
+	values []*templateExpression
+}
+
+// parseLetBindings compiles a $let block, returning the bindings and an environment that declares them.
+// Each binding can use the bindings declared before it.
+func parseLetBindings(env *templateEnv, jObj []byte, scope *outputScope) (*letBindings, *templateEnv, error) {
+	lets := &letBindings{}
+
+	err := jsonparser.ObjectEach(jObj,
+		func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+			name := string(key)
+			if !celIdentifier.MatchString(name) {
+				return fmt.Errorf("%s: invalid variable name %s", letKey, name)
+			}
+			if containsString(reservedLetNames, name) {
+				return fmt.Errorf("%s: variable %s is already in use", letKey, name)
+			}
+			if dataType != jsonparser.String {
+				return fmt.Errorf("%s: variable %s must be a CEL expression", letKey, name)
+			}
+
+			expr, err := compileExpression(env, string(value), missingKeysDefault)
+			if err != nil {
+				return fmt.Errorf("%s: variable %s: %w", letKey, name, err)
+			}
+			if err := scope.check(expr.ast); err != nil {
+				return fmt.Errorf("%s: variable %s: %w", letKey, name, err)
+			}
+
+			// The variable has the type of its expression
+			env, err = env.extend(cel.Variable(name, expr.ast.OutputType()))
+			if err != nil {
+				return fmt.Errorf("%s: variable %s: %w", letKey, name, err)
+			}
+
+			lets.names = append(lets.names, name)
+			lets.values = append(lets.values, expr)
+			return nil
+		})
+
+	if err != nil {
+		return nil, nil, err
+	}
+	return lets, env, nil
+}
+
+// bindLets evaluates the $let variables and returns a new activation that includes them
+func (t *celTemplate) bindLets(input map[string]any, lets *letBindings) (map[string]any, error) {
+	boundInput := make(map[string]any, len(input)+len(lets.names))
+	for name, value := range input {
+		boundInput[name] = value
+	}
+
+	for i, expr := range lets.values {
+		out, err := expr.eval(boundInput)
+		if err != nil {
+			if fatalErr := t.checkEvalError(err, expr.missingKeys); fatalErr != nil {
+				return nil, fatalErr
+			}
+			// Variables that can't be evaluated hold the error, so expressions that use them fail
+			// in the same way, including reporting missing keys for required keys
+			boundInput[lets.names[i]] = types.WrapErr(err)
+			continue
+		}
+		boundInput[lets.names[i]] = out
+	}
+
+	return boundInput, nil
+}
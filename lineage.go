@@ -0,0 +1,327 @@
+package celjsontemplates
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+)
+
+// LineageField is a field of the template output and the input fields that it depends on
+type LineageField struct {
+	// Output is the JSON path of the output value, e.g. $.rows[*].total. The items produced by list
+	// based fragments and macros are written as [*].
+	Output string
+	// Inputs are the data and ref fields the value depends on, in the form used by References
+	Inputs []string
+}
+
+// Lineage lists the fields of the template output in template order. Each output path is listed once.
+type Lineage []LineageField
+
+// Json returns the lineage as a JSON object mapping each output path to its inputs
+func (l Lineage) Json() ([]byte, error) {
+	result := orderedmap.New[string, []string]()
+	for _, field := range l {
+		inputs := field.Inputs
+		if inputs == nil {
+			inputs = []string{}
+		}
+		result.Set(field.Output, inputs)
+	}
+	return json.Marshal(result)
+}
+
+// Dot returns the lineage as a Graphviz DOT graph with an edge from each input field to the output fields that use it
+func (l Lineage) Dot() string {
+	var b strings.Builder
+	b.WriteString("digraph lineage {\n")
+	b.WriteString("  rankdir=LR;\n")
+	for _, field := range l {
+		fmt.Fprintf(&b, "  %s [shape=box];\n", dotQuote(field.Output))
+		for _, input := range field.Inputs {
+			fmt.Fprintf(&b, "  %s -> %s;\n", dotQuote(input), dotQuote(field.Output))
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func dotQuote(id string) string {
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(id, `\`, `\\`), `"`, `\"`) + `"`
+}
+
+// lineageScope describes how the variables available to an expression relate to the input fields
+type lineageScope struct {
+	// paths maps variables that hold an input field to its path. Fragment arguments are held as
+	// args[0], args[1] and so on.
+	paths map[string]string
+	// inputs maps other variables to the input fields they were computed from
+	inputs map[string][]string
+}
+
+func (s *lineageScope) child() *lineageScope {
+	c := &lineageScope{
+		paths:  make(map[string]string, len(s.paths)),
+		inputs: make(map[string][]string, len(s.inputs)),
+	}
+	for name, path := range s.paths {
+		c.paths[name] = path
+	}
+	for name, inputs := range s.inputs {
+		c.inputs[name] = inputs
+	}
+	return c
+}
+
+// bind records the value of a variable, evaluated in scope from
+func (s *lineageScope) bind(name string, e ast.Expr, from *lineageScope) {
+	path, inputs := from.valueOf(e)
+	s.bindValue(name, path, inputs)
+}
+
+// bindItem records that a variable holds an item of the list e, evaluated in scope from
+func (s *lineageScope) bindItem(name string, e ast.Expr, from *lineageScope) {
+	path, inputs := from.valueOf(e)
+	if path != "" {
+		path += "[*]"
+	}
+	s.bindValue(name, path, inputs)
+}
+
+// bindValue records that a variable holds the input field at path, or if path is empty that it was computed from inputs
+func (s *lineageScope) bindValue(name string, path string, inputs []string) {
+	delete(s.paths, name)
+	delete(s.inputs, name)
+	if path != "" {
+		s.paths[name] = path
+	} else {
+		s.inputs[name] = inputs
+	}
+}
+
+// valueOf returns the path of the input field that e selects, or if e does more than select a
+// field (such as data.items[data.index]), the input fields that it uses
+func (s *lineageScope) valueOf(e ast.Expr) (string, []string) {
+	inputs := s.dependencies(e)
+	if path, ok := fieldPath(e, s.paths); ok && len(inputs) == 1 && inputs[0] == path {
+		return path, nil
+	}
+	return "", inputs
+}
+
+// dependencies returns the input fields used by an expression, directly or through variables
+func (s *lineageScope) dependencies(e ast.Expr) []string {
+	inputs := accessedPaths(e, s.paths)
+	for name := range freeVariables(e) {
+		inputs = append(inputs, s.variableInputs(e, name)...)
+	}
+	return uniqueSorted(inputs)
+}
+
+// variableInputs returns the input fields used through a variable. Variables that are only used
+// with a constant index, such as args[1], use the inputs of those items.
+func (s *lineageScope) variableInputs(e ast.Expr, name string) []string {
+	uses := 0
+	var items []string
+	visitExpr(e, func(e ast.Expr) {
+		switch e.Kind() {
+		case ast.IdentKind:
+			if e.AsIdent() == name {
+				uses++
+			}
+		case ast.CallKind:
+			call := e.AsCall()
+			if call.FunctionName() != operators.Index || call.IsMemberFunction() {
+				return
+			}
+			operand, index := call.Args()[0], call.Args()[1]
+			if operand.Kind() == ast.IdentKind && operand.AsIdent() == name && index.Kind() == ast.LiteralKind {
+				items = append(items, name+indexSegment(index))
+			}
+		}
+	})
+	if uses != len(items) {
+		return s.inputs[name]
+	}
+
+	var inputs []string
+	for _, item := range items {
+		// Items that hold a field are already included by their path
+		inputs = append(inputs, s.inputs[item]...)
+	}
+	return inputs
+}
+
+// lineageBuilder follows the template and the fragments it calls to find the lineage of the output
+type lineageBuilder struct {
+	t      *celTemplate
+	fields Lineage
+	// active holds the fragments being followed, so that recursive fragments are only followed once
+	active []string
+}
+
+func (t *celTemplate) Lineage() Lineage {
+	b := &lineageBuilder{t: t}
+	scope := &lineageScope{
+		paths:  map[string]string{"data": "data", "ref": "ref"},
+		inputs: map[string][]string{},
+	}
+	b.node(t.compiledTemplate, "$", scope)
+	return b.fields.merged()
+}
+
+// merged combines fields with the same output path, such as the fields of fragments called by
+// either branch of a condition, keeping the position of the first
+func (l Lineage) merged() Lineage {
+	var result Lineage
+	positions := make(map[string]int, len(l))
+	for _, field := range l {
+		i, found := positions[field.Output]
+		if !found {
+			positions[field.Output] = len(result)
+			result = append(result, field)
+			continue
+		}
+		if len(field.Inputs) > 0 {
+			result[i].Inputs = uniqueSorted(append(append([]string{}, result[i].Inputs...), field.Inputs...))
+		}
+	}
+	return result
+}
+
+// node adds the output fields of a value from the compiled template at the output path out
+func (b *lineageBuilder) node(node any, out string, scope *lineageScope) {
+	switch val := node.(type) {
+	case *templateExpression:
+		e := val.ast.NativeRep().Expr()
+		b.fields = append(b.fields, LineageField{Output: out, Inputs: scope.dependencies(e)})
+		b.fragments(e, out, scope)
+	case *orderedmap.OrderedMap[string, any]:
+		// $let variables apply to the rest of this object only
+		scope = scope.child()
+		for pair := val.Oldest(); pair != nil; pair = pair.Next() {
+			if lets, ok := pair.Value.(*letBindings); ok {
+				for i, name := range lets.names {
+					scope.bind(name, lets.values[i].ast.NativeRep().Expr(), scope)
+				}
+				continue
+			}
+			b.node(pair.Value, out+fieldSegment(pair.Key), scope)
+		}
+	case []any:
+		for i, item := range val {
+			b.node(item, fmt.Sprintf("%s[%d]", out, i), scope)
+		}
+	default:
+		b.fields = append(b.fields, LineageField{Output: out})
+	}
+}
+
+// fragments adds the output fields of any fragments whose output becomes the value at out
+func (b *lineageBuilder) fragments(e ast.Expr, out string, scope *lineageScope) {
+	switch e.Kind() {
+	case ast.CallKind:
+		call := e.AsCall()
+		switch call.FunctionName() {
+		case "fragment":
+			b.fragmentCall(e, out, scope)
+		case operators.Conditional:
+			b.fragments(call.Args()[1], out, scope)
+			b.fragments(call.Args()[2], out, scope)
+		}
+	case ast.ComprehensionKind:
+		// Macros such as map produce a list holding the fragment output for each item
+		comp := e.AsComprehension()
+		loopScope := scope.child()
+		loopScope.bindItem(comp.IterVar(), comp.IterRange(), scope)
+		visitExpr(comp.LoopStep(), func(step ast.Expr) {
+			if step.Kind() == ast.CallKind && step.AsCall().FunctionName() == "fragment" {
+				b.fragmentCall(step, out+"[*]", loopScope)
+			}
+		})
+	}
+}
+
+// fragmentCall adds the output fields of a call to a fragment with a constant name
+func (b *lineageBuilder) fragmentCall(e ast.Expr, out string, scope *lineageScope) {
+	name, ok := fragmentCallName(e)
+	if !ok || containsString(b.active, name) {
+		return
+	}
+	cf, found := b.t.compiledFragments[name]
+	if !found {
+		return
+	}
+
+	fragmentScope := &lineageScope{
+		paths:  map[string]string{"data": "data", "ref": "ref"},
+		inputs: map[string][]string{},
+	}
+	var positional []ast.Expr
+	call := e.AsCall()
+	if call.IsMemberFunction() {
+		// The fragment is called with each item of the list, followed by any other arguments
+		out += "[*]"
+		target := call.Target()
+		fragmentScope.bindItem("args[0]", target, scope)
+		positional = append(positional, target)
+	}
+
+	var allInputs []string
+	switch args := call.Args()[2]; args.Kind() {
+	case ast.ListKind:
+		positional = append(positional, args.AsList().Elements()...)
+	case ast.MapKind:
+		if len(cf.params) == 0 {
+			// Fragments without parameters are passed the map as their only argument
+			positional = append(positional, args)
+			break
+		}
+		for _, entry := range args.AsMap().Entries() {
+			key, value := entry.AsMapEntry().Key(), entry.AsMapEntry().Value()
+			param, ok := key.AsLiteral().(types.String)
+			if key.Kind() != ast.LiteralKind || !ok {
+				continue
+			}
+			fragmentScope.bind(string(param), value, scope)
+			allInputs = append(allInputs, scope.dependencies(value)...)
+		}
+	}
+
+	for i, arg := range positional {
+		argName := fmt.Sprintf("args[%d]", i)
+		allInputs = append(allInputs, scope.dependencies(arg)...)
+		// The item of a list based call is bound above
+		if i > 0 || !call.IsMemberFunction() {
+			fragmentScope.bind(argName, arg, scope)
+		}
+		if i < len(cf.params) {
+			fragmentScope.paths[cf.params[i]] = fragmentScope.paths[argName]
+			fragmentScope.inputs[cf.params[i]] = fragmentScope.inputs[argName]
+		}
+	}
+	// args as a whole, or with an index that isn't constant, could be any of the arguments
+	fragmentScope.inputs["args"] = uniqueSorted(allInputs)
+
+	b.active = append(b.active, name)
+	b.node(cf.body, out, fragmentScope)
+	b.active = b.active[:len(b.active)-1]
+}
+
+// uniqueSorted sorts a list of strings and removes any duplicates
+func uniqueSorted(list []string) []string {
+	sort.Strings(list)
+	result := list[:0]
+	for i, item := range list {
+		if i == 0 || item != list[i-1] {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,191 @@
+package celjsontemplates
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+)
+
+// msgpackTimestampExt is the extension type reserved for timestamps by the MessagePack spec
+const msgpackTimestampExt = 0xff
+
+// MessagePackEncoder encodes the template output as MessagePack.
+// Maps keep their template key order, bytes are written using the bin format family and
+// timestamps use the timestamp extension type (-1).
+type MessagePackEncoder struct{}
+
+// Encode implements Encoder
+func (e MessagePackEncoder) Encode(value any) ([]byte, error) {
+	nv, err := normalizeOutput(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = e.writeValue(&buf, nv)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (e MessagePackEncoder) writeValue(buf *bytes.Buffer, value any) error {
+	switch val := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if val {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case int64:
+		writeMsgpackInt(buf, val)
+	case uint64:
+		writeMsgpackUint(buf, val)
+	case float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(val))
+	case string:
+		writeMsgpackString(buf, val)
+	case []byte:
+		switch l := len(val); {
+		case l <= math.MaxUint8:
+			buf.WriteByte(0xc4)
+			buf.WriteByte(byte(l))
+		case l <= math.MaxUint16:
+			buf.WriteByte(0xc5)
+			binary.Write(buf, binary.BigEndian, uint16(l))
+		default:
+			buf.WriteByte(0xc6)
+			binary.Write(buf, binary.BigEndian, uint32(l))
+		}
+		buf.Write(val)
+	case time.Time:
+		writeMsgpackTimestamp(buf, val)
+	case time.Duration:
+		writeMsgpackInt(buf, int64(val))
+	case []any:
+		switch l := len(val); {
+		case l < 16:
+			buf.WriteByte(0x90 | byte(l))
+		case l <= math.MaxUint16:
+			buf.WriteByte(0xdc)
+			binary.Write(buf, binary.BigEndian, uint16(l))
+		default:
+			buf.WriteByte(0xdd)
+			binary.Write(buf, binary.BigEndian, uint32(l))
+		}
+		for _, item := range val {
+			err := e.writeValue(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+	case *orderedmap.OrderedMap[string, any]:
+		switch l := val.Len(); {
+		case l < 16:
+			buf.WriteByte(0x80 | byte(l))
+		case l <= math.MaxUint16:
+			buf.WriteByte(0xde)
+			binary.Write(buf, binary.BigEndian, uint16(l))
+		default:
+			buf.WriteByte(0xdf)
+			binary.Write(buf, binary.BigEndian, uint32(l))
+		}
+		for pair := val.Oldest(); pair != nil; pair = pair.Next() {
+			writeMsgpackString(buf, pair.Key)
+			err := e.writeValue(buf, pair.Value)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", value)
+	}
+	return nil
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, val int64) {
+	switch {
+	case val >= 0:
+		writeMsgpackUint(buf, uint64(val))
+	case val >= -32:
+		buf.WriteByte(byte(val))
+	case val >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(val))
+	case val >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(val))
+	case val >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(val))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, val)
+	}
+}
+
+func writeMsgpackUint(buf *bytes.Buffer, val uint64) {
+	switch {
+	case val < 128:
+		buf.WriteByte(byte(val))
+	case val <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(val))
+	case val <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(val))
+	case val <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(val))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, val)
+	}
+}
+
+func writeMsgpackString(buf *bytes.Buffer, val string) {
+	switch l := len(val); {
+	case l < 32:
+		buf.WriteByte(0xa0 | byte(l))
+	case l <= math.MaxUint8:
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(l))
+	case l <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		binary.Write(buf, binary.BigEndian, uint16(l))
+	default:
+		buf.WriteByte(0xdb)
+		binary.Write(buf, binary.BigEndian, uint32(l))
+	}
+	buf.WriteString(val)
+}
+
+// writeMsgpackTimestamp uses the smallest of the timestamp 32, 64 and 96 formats that fits
+func writeMsgpackTimestamp(buf *bytes.Buffer, val time.Time) {
+	sec := val.Unix()
+	nsec := uint32(val.Nanosecond())
+
+	switch {
+	case sec >= 0 && sec>>34 == 0 && nsec == 0 && sec <= math.MaxUint32:
+		buf.WriteByte(0xd6)
+		buf.WriteByte(msgpackTimestampExt)
+		binary.Write(buf, binary.BigEndian, uint32(sec))
+	case sec >= 0 && sec>>34 == 0:
+		buf.WriteByte(0xd7)
+		buf.WriteByte(msgpackTimestampExt)
+		binary.Write(buf, binary.BigEndian, uint64(nsec)<<34|uint64(sec))
+	default:
+		buf.WriteByte(0xc7)
+		buf.WriteByte(12)
+		buf.WriteByte(msgpackTimestampExt)
+		binary.Write(buf, binary.BigEndian, nsec)
+		binary.Write(buf, binary.BigEndian, sec)
+	}
+}
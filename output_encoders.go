@@ -0,0 +1,195 @@
+package celjsontemplates
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Encoder turns the expanded template output into bytes.
+// The value passed to Encode is the output tree: an *orderedmap.OrderedMap[string, any] holding
+// the expanded values in template order.
+type Encoder interface {
+	Encode(value any) ([]byte, error)
+}
+
+// JsonEncoder is the default Encoder and produces JSON output.
+type JsonEncoder struct{}
+
+// Encode implements Encoder
+func (e JsonEncoder) Encode(value any) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+// normalizeOutput converts an output tree into plain Go values so that encoders only have to deal
+// with a small set of types:
+// nil, bool, int64, uint64, float64, string, []byte, time.Time, time.Duration, []any
+// and *orderedmap.OrderedMap[string, any].
+// Maps that don't carry an order (e.g. Go maps passed in as data) have their keys sorted so the
+// output is stable.
+func normalizeOutput(value any) (any, error) {
+	switch val := value.(type) {
+	case nil:
+		return nil, nil
+	case ref.Val:
+		return normalizeCelValue(val)
+	case *orderedmap.OrderedMap[string, any]:
+		result := orderedmap.New[string, any]()
+		for pair := val.Oldest(); pair != nil; pair = pair.Next() {
+			nv, err := normalizeOutput(pair.Value)
+			if err != nil {
+				return nil, err
+			}
+			result.Set(pair.Key, nv)
+		}
+		return result, nil
+	case []any:
+		result := make([]any, 0, len(val))
+		for _, item := range val {
+			nv, err := normalizeOutput(item)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, nv)
+		}
+		return result, nil
+	case bool, string, []byte, time.Time, time.Duration, int64, uint64, float64:
+		return val, nil
+	case int:
+		return int64(val), nil
+	case int8:
+		return int64(val), nil
+	case int16:
+		return int64(val), nil
+	case int32:
+		return int64(val), nil
+	case uint:
+		return uint64(val), nil
+	case uint8:
+		return uint64(val), nil
+	case uint16:
+		return uint64(val), nil
+	case uint32:
+		return uint64(val), nil
+	case float32:
+		return float64(val), nil
+	case structpb.NullValue:
+		return nil, nil
+	}
+
+	// Fall back to reflection for other slices and maps
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return normalizeOutput(rv.Elem().Interface())
+	case reflect.Slice, reflect.Array:
+		result := make([]any, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			nv, err := normalizeOutput(rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, nv)
+		}
+		return result, nil
+	case reflect.Map:
+		keys := make([]string, 0, rv.Len())
+		values := make(map[string]any, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			key := fmt.Sprint(iter.Key().Interface())
+			keys = append(keys, key)
+			values[key] = iter.Value().Interface()
+		}
+		sort.Strings(keys)
+		result := orderedmap.New[string, any]()
+		for _, key := range keys {
+			nv, err := normalizeOutput(values[key])
+			if err != nil {
+				return nil, err
+			}
+			result.Set(key, nv)
+		}
+		return result, nil
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	}
+	return nil, fmt.Errorf("unsupported output type %T", value)
+}
+
+// normalizeCelValue converts a CEL value into the plain Go values used by normalizeOutput
+func normalizeCelValue(val ref.Val) (any, error) {
+	switch v := val.(type) {
+	case *orderedCelMap:
+		return normalizeOutput(v.m)
+	case types.Null:
+		return nil, nil
+	case types.Bool:
+		return bool(v), nil
+	case types.Int:
+		return int64(v), nil
+	case types.Uint:
+		return uint64(v), nil
+	case types.Double:
+		return float64(v), nil
+	case types.String:
+		return string(v), nil
+	case types.Bytes:
+		return []byte(v), nil
+	case types.Timestamp:
+		return v.Time, nil
+	case types.Duration:
+		return v.Duration, nil
+	case *types.Err:
+		return nil, v
+	case traits.Mapper:
+		keys := make([]string, 0)
+		values := make(map[string]ref.Val)
+		for it := v.Iterator(); it.HasNext() == types.True; {
+			key := it.Next()
+			keyStr := fmt.Sprint(key.Value())
+			keys = append(keys, keyStr)
+			values[keyStr] = v.Get(key)
+		}
+		sort.Strings(keys)
+		result := orderedmap.New[string, any]()
+		for _, key := range keys {
+			nv, err := normalizeCelValue(values[key])
+			if err != nil {
+				return nil, err
+			}
+			result.Set(key, nv)
+		}
+		return result, nil
+	case traits.Lister:
+		result := make([]any, 0)
+		for it := v.Iterator(); it.HasNext() == types.True; {
+			nv, err := normalizeCelValue(it.Next())
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, nv)
+		}
+		return result, nil
+	}
+	return normalizeOutput(val.Value())
+}
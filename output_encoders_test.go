@@ -0,0 +1,143 @@
+package celjsontemplates_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	celjsontemplates "github.com/cms103/cel-json-templates"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+)
+
+func TestCborEncoderKeepsKeyOrder(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"b": "'x'", "a": 1}`, celjsontemplates.WithEncoder(celjsontemplates.CborEncoder{}))
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if hex.EncodeToString(res) != "a2616261786161fb3ff0000000000000" {
+		t.Errorf("Unexpected CBOR output: %x", res)
+	}
+}
+
+func TestCborEncoderDeterministic(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"b": "'x'", "a": 1}`, celjsontemplates.WithEncoder(celjsontemplates.CborEncoder{Deterministic: true}))
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	if hex.EncodeToString(res) != "a26161f93c0061626178" {
+		t.Errorf("Unexpected CBOR output: %x", res)
+	}
+}
+
+func TestCborEncoderNativeTypes(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"bin": "b'ab'", "ts": "timestamp('2023-01-01T00:00:00Z')", "list": "[data.age, -1]"}`,
+		celjsontemplates.WithEncoder(celjsontemplates.CborEncoder{}))
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	// bin is a byte string, ts uses tag 1 and list is [40, -1]
+	expected := "a3" + "6362696e" + "426162" + "627473" + "c11a63b0cd00" + "646c697374" + "82" + "1828" + "20"
+	if hex.EncodeToString(res) != expected {
+		t.Errorf("Unexpected CBOR output: %x", res)
+	}
+}
+
+func TestMessagePackEncoder(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"b": "'x'", "bin": "b'ab'", "ts": "timestamp('2023-01-01T00:00:00Z')", "n": "data.age"}`,
+		celjsontemplates.WithEncoder(celjsontemplates.MessagePackEncoder{}))
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	expected := "84" + "a162" + "a178" + "a362696e" + "c4026162" + "a27473" + "d6ff63b0cd00" + "a16e" + "28"
+	if hex.EncodeToString(res) != expected {
+		t.Errorf("Unexpected MessagePack output: %x", res)
+	}
+}
+
+func TestXmlEncoder(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{
+		"order": {
+			"@xmlns": "'urn:example:orders'",
+			"@id": "data.status",
+			"customer": {"#text": "data.person.Name", "@age": "data.person.Age"},
+			"item": "data.list1.slice(0, 2)",
+			"note": "'a < b & c'"
+		}
+	}`, celjsontemplates.WithEncoder(celjsontemplates.XmlEncoder{}), celjsontemplates.WithCelOptions([]cel.EnvOption{ext.Lists()}))
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	expected := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<order xmlns="urn:example:orders" id="2"><customer age="22">Bob</customer><item>1</item><item>2</item><note>a &lt; b &amp; c</note></order>`
+	if string(res) != expected {
+		t.Errorf("Unexpected XML output: %s", string(res))
+	}
+}
+
+func TestXmlEncoderRootElement(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"name": "data.name", "age": "data.age"}`,
+		celjsontemplates.WithEncoder(celjsontemplates.XmlEncoder{RootElement: "person", Indent: "  "}))
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	expected := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		"<person>\n  <name>a test name</name>\n  <age>40</age>\n</person>\n"
+	if string(res) != expected {
+		t.Errorf("Unexpected XML output: %s", string(res))
+	}
+}
+
+func TestXmlEncoderSingleListKey(t *testing.T) {
+	ourT, err := celjsontemplates.New(`{"item": "[1, 2]"}`,
+		celjsontemplates.WithEncoder(celjsontemplates.XmlEncoder{RootElement: "items"}))
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, err := ourT.Expand(referenceInputData)
+	if err != nil {
+		t.Errorf("Error expanding template: %v", err)
+	}
+
+	expected := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<items><item>1</item><item>2</item></items>`
+	if string(res) != expected {
+		t.Errorf("Unexpected XML output: %s", string(res))
+	}
+}
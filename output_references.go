@@ -0,0 +1,180 @@
+package celjsontemplates
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+)
+
+const (
+	// selfVariable exposes the keys already computed in the current object
+	selfVariable = "self"
+	// rootVariable exposes the top level keys already computed in the template output
+	rootVariable = "root"
+)
+
+// outputScope tracks the output keys that are computed before the expression being compiled.
+// A nil scope means that output references are disabled.
+type outputScope struct {
+	// keys holds the keys computed so far in the current object
+	keys []string
+	// root is the scope of the top level object, nil when this is the top level object
+	root *outputScope
+}
+
+// newOutputScope returns the scope for the top level object of a template or fragment
+func newOutputScope(enabled bool) *outputScope {
+	if !enabled {
+		return nil
+	}
+	return &outputScope{}
+}
+
+// child returns the scope for an object nested within this one
+func (s *outputScope) child() *outputScope {
+	if s == nil {
+		return nil
+	}
+	return &outputScope{root: s.rootScope()}
+}
+
+func (s *outputScope) rootScope() *outputScope {
+	if s.root == nil {
+		return s
+	}
+	return s.root
+}
+
+// add records that key has been computed
+func (s *outputScope) add(key string) {
+	if s == nil {
+		return
+	}
+	s.keys = append(s.keys, key)
+}
+
+// check rejects an expression that uses self or root other than to select a key that is computed
+// before it. This rules out forward and cyclic references between output keys.
+func (s *outputScope) check(checked *cel.Ast) error {
+	if s == nil {
+		return nil
+	}
+	return s.checkExpr(checked.NativeRep().Expr(), map[string]bool{})
+}
+
+func (s *outputScope) checkExpr(e ast.Expr, shadowed map[string]bool) error {
+	switch e.Kind() {
+	case ast.IdentKind:
+		if s.isOutputVariable(e, shadowed) {
+			return fmt.Errorf("%s can only be used to select an earlier output key", e.AsIdent())
+		}
+	case ast.SelectKind:
+		sel := e.AsSelect()
+		if s.isOutputVariable(sel.Operand(), shadowed) {
+			return s.checkKey(sel.Operand().AsIdent(), sel.FieldName())
+		}
+		return s.checkExpr(sel.Operand(), shadowed)
+	case ast.CallKind:
+		call := e.AsCall()
+		args := call.Args()
+		switch call.FunctionName() {
+		case operators.Index, operators.OptIndex, operators.OptSelect:
+			if s.isOutputVariable(args[0], shadowed) {
+				key, ok := args[1].AsLiteral().(types.String)
+				if args[1].Kind() != ast.LiteralKind || !ok {
+					return fmt.Errorf("%s can only be indexed with a constant key", args[0].AsIdent())
+				}
+				return s.checkKey(args[0].AsIdent(), string(key))
+			}
+		}
+		if call.IsMemberFunction() {
+			if err := s.checkExpr(call.Target(), shadowed); err != nil {
+				return err
+			}
+		}
+		for _, arg := range args {
+			if err := s.checkExpr(arg, shadowed); err != nil {
+				return err
+			}
+		}
+	case ast.ListKind:
+		for _, elem := range e.AsList().Elements() {
+			if err := s.checkExpr(elem, shadowed); err != nil {
+				return err
+			}
+		}
+	case ast.MapKind:
+		for _, entry := range e.AsMap().Entries() {
+			if err := s.checkExpr(entry.AsMapEntry().Key(), shadowed); err != nil {
+				return err
+			}
+			if err := s.checkExpr(entry.AsMapEntry().Value(), shadowed); err != nil {
+				return err
+			}
+		}
+	case ast.StructKind:
+		for _, field := range e.AsStruct().Fields() {
+			if err := s.checkExpr(field.AsStructField().Value(), shadowed); err != nil {
+				return err
+			}
+		}
+	case ast.ComprehensionKind:
+		comp := e.AsComprehension()
+		if err := s.checkExpr(comp.IterRange(), shadowed); err != nil {
+			return err
+		}
+		if err := s.checkExpr(comp.AccuInit(), shadowed); err != nil {
+			return err
+		}
+		// The loop variables hide self and root within the loop
+		loopShadowed := map[string]bool{comp.IterVar(): true, comp.AccuVar(): true}
+		for name := range shadowed {
+			loopShadowed[name] = true
+		}
+		for _, loopExpr := range []ast.Expr{comp.LoopCondition(), comp.LoopStep(), comp.Result()} {
+			if err := s.checkExpr(loopExpr, loopShadowed); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *outputScope) isOutputVariable(e ast.Expr, shadowed map[string]bool) bool {
+	if e.Kind() != ast.IdentKind {
+		return false
+	}
+	name := e.AsIdent()
+	return (name == selfVariable || name == rootVariable) && !shadowed[name]
+}
+
+// checkKey checks that key is computed before the current expression
+func (s *outputScope) checkKey(variable string, key string) error {
+	scope := s
+	if variable == rootVariable {
+		scope = s.rootScope()
+	}
+	if !containsString(scope.keys, key) {
+		return fmt.Errorf("%s.%s refers to an output key that isn't computed before this expression", variable, key)
+	}
+	return nil
+}
+
+// bindOutputReferences returns a new activation with self set to the object being expanded and
+// root set to the top level output.
+func bindOutputReferences(input map[string]any, outputData *orderedmap.OrderedMap[string, interface{}]) map[string]any {
+	boundInput := make(map[string]any, len(input)+2)
+	for name, value := range input {
+		boundInput[name] = value
+	}
+
+	if ex, ok := input[expansionVariable].(*expansion); ok {
+		boundInput[rootVariable] = wrapOrderedCelMap(ex.root)
+	}
+	boundInput[selfVariable] = wrapOrderedCelMap(outputData)
+	return boundInput
+}
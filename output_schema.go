@@ -0,0 +1,303 @@
+package celjsontemplates
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+)
+
+// outputSchemaDialect is the JSON Schema version produced by OutputSchema
+const outputSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// removalFunctions can remove the property that they are used in
+var removalFunctions = []string{"remove_property", "omit_if_empty", "omit_if_null", "value_or_remove"}
+
+type jsonSchema = *orderedmap.OrderedMap[string, any]
+
+// outputSchemaBuilder builds a JSON Schema for the output of a template.
+// Fragments and struct types are described once in $defs.
+type outputSchemaBuilder struct {
+	t    *celTemplate
+	defs *orderedmap.OrderedMap[string, any]
+}
+
+func (t *celTemplate) OutputSchema() ([]byte, error) {
+	b := &outputSchemaBuilder{
+		t:    t,
+		defs: orderedmap.New[string, any](),
+	}
+
+	schema := orderedmap.New[string, any]()
+	schema.Set("$schema", outputSchemaDialect)
+	for pair := b.objectSchema(t.compiledTemplate).Oldest(); pair != nil; pair = pair.Next() {
+		schema.Set(pair.Key, pair.Value)
+	}
+	if b.defs.Len() > 0 {
+		schema.Set("$defs", b.defs)
+	}
+
+	return json.Marshal(schema)
+}
+
+// objectSchema describes an object from the compiled template.
+// Properties that can be removed from the output aren't required.
+func (b *outputSchemaBuilder) objectSchema(node *orderedmap.OrderedMap[string, any]) jsonSchema {
+	properties := orderedmap.New[string, any]()
+	required := []string{}
+
+	for pair := node.Oldest(); pair != nil; pair = pair.Next() {
+		if _, isLet := pair.Value.(*letBindings); isLet {
+			continue
+		}
+		valueSchema, removable := b.valueSchema(pair.Value)
+		properties.Set(pair.Key, valueSchema)
+		if !removable {
+			required = append(required, pair.Key)
+		}
+	}
+
+	schema := newJsonSchema("type", "object")
+	schema.Set("properties", properties)
+	if len(required) > 0 {
+		schema.Set("required", required)
+	}
+	schema.Set("additionalProperties", false)
+	return schema
+}
+
+// listSchema describes a list from the compiled template
+func (b *outputSchemaBuilder) listSchema(nodeList []interface{}) jsonSchema {
+	var itemSchemas []any
+	for _, node := range nodeList {
+		itemSchema, _ := b.valueSchema(node)
+		itemSchemas = appendUniqueSchema(itemSchemas, itemSchema)
+	}
+
+	schema := newJsonSchema("type", "array")
+	switch len(itemSchemas) {
+	case 0:
+	case 1:
+		schema.Set("items", itemSchemas[0])
+	default:
+		schema.Set("items", newJsonSchema("anyOf", itemSchemas))
+	}
+	return schema
+}
+
+// valueSchema describes a value from the compiled template, reporting whether it can be removed from the output
+func (b *outputSchemaBuilder) valueSchema(node any) (jsonSchema, bool) {
+	switch val := node.(type) {
+	case *templateExpression:
+		return b.expressionSchema(val, val.ast.NativeRep().Expr()), b.t.mayBeRemoved(val)
+	case *orderedmap.OrderedMap[string, interface{}]:
+		return b.objectSchema(val), b.t.pruneEmpty
+	case []interface{}:
+		return b.listSchema(val), b.t.pruneEmpty
+	case float64:
+		return newJsonSchema("type", "number"), false
+	case bool:
+		return newJsonSchema("type", "boolean"), false
+	}
+	return orderedmap.New[string, any](), false
+}
+
+// expressionSchema describes the result of an expression, using the fragment definitions for fragment calls
+func (b *outputSchemaBuilder) expressionSchema(expr *templateExpression, e ast.Expr) jsonSchema {
+	if e.Kind() == ast.CallKind {
+		call := e.AsCall()
+		args := call.Args()
+		switch call.FunctionName() {
+		case "fragment":
+			if name, ok := fragmentCallName(e); ok {
+				if _, found := b.t.compiledFragments[name]; found {
+					fragmentRef := b.fragmentRef(name)
+					if call.IsMemberFunction() {
+						schema := newJsonSchema("type", "array")
+						schema.Set("items", fragmentRef)
+						return schema
+					}
+					return fragmentRef
+				}
+			}
+		case operators.Conditional:
+			var branches []any
+			branches = appendUniqueSchema(branches, b.expressionSchema(expr, args[1]))
+			branches = appendUniqueSchema(branches, b.expressionSchema(expr, args[2]))
+			if len(branches) == 1 {
+				return branches[0].(jsonSchema)
+			}
+			return newJsonSchema("anyOf", branches)
+		}
+	}
+	return b.typeSchema(expr.ast.NativeRep().GetType(e.ID()))
+}
+
+// typeSchema describes the JSON output of a CEL type
+func (b *outputSchemaBuilder) typeSchema(celType *types.Type) jsonSchema {
+	if celType == nil {
+		return orderedmap.New[string, any]()
+	}
+
+	var schema jsonSchema
+	switch celType.Kind() {
+	case types.BoolKind:
+		schema = newJsonSchema("type", "boolean")
+	case types.IntKind, types.UintKind, types.DurationKind:
+		schema = newJsonSchema("type", "integer")
+	case types.DoubleKind:
+		schema = newJsonSchema("type", "number")
+	case types.StringKind:
+		schema = newJsonSchema("type", "string")
+	case types.BytesKind:
+		schema = newJsonSchema("type", "string")
+		schema.Set("contentEncoding", "base64")
+	case types.TimestampKind:
+		schema = newJsonSchema("type", "string")
+		schema.Set("format", "date-time")
+	case types.NullTypeKind:
+		return newJsonSchema("type", "null")
+	case types.ListKind:
+		schema = newJsonSchema("type", "array")
+		if items := b.typeSchema(celType.Parameters()[0]); items.Len() > 0 {
+			schema.Set("items", items)
+		}
+		return schema
+	case types.MapKind:
+		schema = newJsonSchema("type", "object")
+		if values := b.typeSchema(celType.Parameters()[1]); values.Len() > 0 {
+			schema.Set("additionalProperties", values)
+		}
+		return schema
+	case types.StructKind:
+		if b.t.typeProvider != nil {
+			if _, found := b.t.typeProvider.structs[celType.TypeName()]; found {
+				return b.structRef(celType.TypeName())
+			}
+		}
+		return newJsonSchema("type", "object")
+	case types.OpaqueKind:
+		if celType.TypeName() == types.OptionalType.TypeName() {
+			return b.typeSchema(celType.Parameters()[0])
+		}
+		return orderedmap.New[string, any]()
+	default:
+		return orderedmap.New[string, any]()
+	}
+
+	// Wrapper types such as those used for nullable fields can also be null
+	if celType.IsAssignableType(types.NullType) {
+		kind, _ := schema.Get("type")
+		schema.Set("type", []any{kind, "null"})
+	}
+	return schema
+}
+
+// fragmentRef returns a reference to the definition of a fragment, adding it if needed
+func (b *outputSchemaBuilder) fragmentRef(name string) jsonSchema {
+	defName := "fragment." + name
+	if _, found := b.defs.Get(defName); !found {
+		// Add a placeholder first so that recursive fragments refer to the same definition
+		b.defs.Set(defName, true)
+		b.defs.Set(defName, b.objectSchema(b.t.compiledFragments[name].body))
+	}
+	return newJsonSchema("$ref", "#/$defs/"+defName)
+}
+
+// structRef returns a reference to the definition of a struct type, adding it if needed.
+// The fields of a struct type may be missing from the data, so none are required.
+func (b *outputSchemaBuilder) structRef(name string) jsonSchema {
+	if _, found := b.defs.Get(name); !found {
+		b.defs.Set(name, true)
+
+		fields := b.t.typeProvider.structs[name]
+		fieldNames := make([]string, 0, len(fields))
+		for field := range fields {
+			fieldNames = append(fieldNames, field)
+		}
+		sort.Strings(fieldNames)
+
+		properties := orderedmap.New[string, any]()
+		for _, field := range fieldNames {
+			properties.Set(field, b.typeSchema(fields[field]))
+		}
+		schema := newJsonSchema("type", "object")
+		schema.Set("properties", properties)
+		b.defs.Set(name, schema)
+	}
+	return newJsonSchema("$ref", "#/$defs/"+name)
+}
+
+// mayBeRemoved reports whether an expression may be left out of the output
+func (t *celTemplate) mayBeRemoved(expr *templateExpression) bool {
+	checked := expr.ast.NativeRep()
+	if checked.GetType(checked.Expr().ID()).TypeName() == types.OptionalType.TypeName() {
+		return true
+	}
+
+	removes := false
+	visitExpr(checked.Expr(), func(e ast.Expr) {
+		if e.Kind() != ast.CallKind {
+			return
+		}
+		call := e.AsCall()
+		if containsString(removalFunctions, call.FunctionName()) {
+			removes = true
+		}
+		// fail_if without a value removes the property when the condition is false
+		if call.FunctionName() == "fail_if" && len(call.Args()) == 3 {
+			removes = true
+		}
+	})
+	if removes {
+		return true
+	}
+
+	// Missing keys remove the property, unless they stop the expansion instead
+	if expr.missingKeys == missingKeysRequired || (expr.missingKeys == missingKeysDefault && t.errorOnMissingKeys) {
+		return false
+	}
+	for name := range freeVariables(checked.Expr()) {
+		switch name {
+		case expansionVariable:
+		case "ref":
+			if !t.typedRef {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// fragmentCallName returns the name of the fragment called by e, if it is a constant
+func fragmentCallName(e ast.Expr) (string, bool) {
+	args := e.AsCall().Args()
+	if len(args) < 2 || args[1].Kind() != ast.LiteralKind {
+		return "", false
+	}
+	name, ok := args[1].AsLiteral().(types.String)
+	return string(name), ok
+}
+
+func newJsonSchema(key string, value any) jsonSchema {
+	schema := orderedmap.New[string, any]()
+	schema.Set(key, value)
+	return schema
+}
+
+// appendUniqueSchema adds schema to schemas unless an identical schema is already present
+func appendUniqueSchema(schemas []any, schema jsonSchema) []any {
+	encoded, _ := json.Marshal(schema)
+	for _, existing := range schemas {
+		existingEncoded, _ := json.Marshal(existing)
+		if string(existingEncoded) == string(encoded) {
+			return schemas
+		}
+	}
+	return append(schemas, schema)
+}
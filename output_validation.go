@@ -0,0 +1,515 @@
+package celjsontemplates
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+)
+
+// maxSchemaRefDepth limits how many $refs can be followed without moving into the value, so that
+// a schema that refers to itself can't loop forever
+const maxSchemaRefDepth = 64
+
+// SchemaViolation describes an output value that doesn't match the schema given by WithOutputSchema
+type SchemaViolation struct {
+	// Pointer is the JSON pointer of the value in the output, e.g. /items/0/price
+	Pointer string
+	// Template is the JSON pointer of the template value that produced it, prefixed with the
+	// fragment name for values from fragments, e.g. #/items or item#/price
+	Template string
+	// Message describes the problem
+	Message string
+}
+
+func (v SchemaViolation) String() string {
+	pointer := v.Pointer
+	if pointer == "" {
+		pointer = "(root)"
+	}
+	if v.Template == "" {
+		return fmt.Sprintf("%s: %s", pointer, v.Message)
+	}
+	return fmt.Sprintf("%s (template %s): %s", pointer, v.Template, v.Message)
+}
+
+// OutputSchemaError is returned by Expand when the output doesn't match the schema given by WithOutputSchema.
+// It lists every problem that was found.
+type OutputSchemaError struct {
+	Violations []SchemaViolation
+}
+
+func (e *OutputSchemaError) Error() string {
+	problems := make([]string, 0, len(e.Violations))
+	for _, violation := range e.Violations {
+		problems = append(problems, violation.String())
+	}
+	return "output doesn't match schema: " + strings.Join(problems, "; ")
+}
+
+// outputValidator checks the output tree against a JSON Schema. Only local references are
+// supported, nothing is fetched.
+type outputValidator struct {
+	root any
+	// patterns holds the compiled pattern and patternProperties regular expressions
+	patterns map[string]*regexp.Regexp
+}
+
+// parseOutputSchema reads a JSON Schema, checking that its references and patterns can be used
+func parseOutputSchema(jsonSchema []byte) (*outputValidator, error) {
+	v := &outputValidator{patterns: make(map[string]*regexp.Regexp)}
+	err := json.Unmarshal(jsonSchema, &v.root)
+	if err != nil {
+		return nil, fmt.Errorf("output schema: %w", err)
+	}
+
+	err = v.prepare(v.root)
+	if err != nil {
+		return nil, fmt.Errorf("output schema: %w", err)
+	}
+	return v, nil
+}
+
+// unsupportedKeywords are the JSON Schema keywords that the output validator doesn't implement.
+// They are rejected rather than ignored, so that output isn't accepted without being checked.
+var unsupportedKeywords = []string{
+	"contains", "minContains", "maxContains", "propertyNames", "dependentRequired", "dependentSchemas",
+	"dependencies", "unevaluatedProperties", "unevaluatedItems", "additionalItems", "$dynamicRef", "$recursiveRef",
+}
+
+// prepare resolves the references and compiles the patterns found anywhere in schema, and checks
+// that it only uses keywords that are supported
+func (v *outputValidator) prepare(schema any) error {
+	s, ok := schema.(map[string]any)
+	if !ok {
+		return nil
+	}
+
+	for key, value := range s {
+		if containsString(unsupportedKeywords, key) {
+			return fmt.Errorf("the %s keyword isn't supported", key)
+		}
+
+		switch key {
+		case "$ref":
+			if ref, ok := value.(string); ok {
+				if _, err := v.resolveRef(ref); err != nil {
+					return err
+				}
+			}
+		case "pattern":
+			if pattern, ok := value.(string); ok {
+				if err := v.addPattern(pattern); err != nil {
+					return err
+				}
+			}
+		case "items", "additionalProperties", "not", "if", "then", "else":
+			if err := v.prepare(value); err != nil {
+				return err
+			}
+		case "prefixItems", "allOf", "anyOf", "oneOf":
+			items, _ := value.([]any)
+			for _, item := range items {
+				if err := v.prepare(item); err != nil {
+					return err
+				}
+			}
+		case "properties", "patternProperties", "$defs", "definitions":
+			// The keys of these keywords are names, only their values are schemas
+			schemas, _ := value.(map[string]any)
+			for name, item := range schemas {
+				if key == "patternProperties" {
+					if err := v.addPattern(name); err != nil {
+						return err
+					}
+				}
+				if err := v.prepare(item); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (v *outputValidator) addPattern(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %s: %w", pattern, err)
+	}
+	v.patterns[pattern] = re
+	return nil
+}
+
+// resolveRef finds the schema referred to by a local $ref such as #/$defs/address
+func (v *outputValidator) resolveRef(ref string) (any, error) {
+	if ref == "#" {
+		return v.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("only local references are supported, got %s", ref)
+	}
+
+	target := v.root
+	for _, segment := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		segment = strings.ReplaceAll(strings.ReplaceAll(segment, "~1", "/"), "~0", "~")
+		switch t := target.(type) {
+		case map[string]any:
+			var found bool
+			target, found = t[segment]
+			if !found {
+				return nil, fmt.Errorf("unable to resolve reference %s", ref)
+			}
+		default:
+			return nil, fmt.Errorf("unable to resolve reference %s", ref)
+		}
+	}
+	return target, nil
+}
+
+// check validates the output tree, attributing any violations to the template values recorded by the expansion
+func (v *outputValidator) check(output any, ex *expansion) error {
+	value, err := normalizeOutput(output)
+	if err != nil {
+		return err
+	}
+
+	violations := v.validate(v.root, value, "", 0)
+	if len(violations) == 0 {
+		return nil
+	}
+	for i := range violations {
+		violations[i].Template = ex.sourceOf(violations[i].Pointer)
+	}
+	return &OutputSchemaError{Violations: violations}
+}
+
+// validate checks a normalized output value against schema, returning every violation found.
+// refDepth counts the $refs followed since the last move into the value.
+func (v *outputValidator) validate(schema any, value any, pointer string, refDepth int) []SchemaViolation {
+	var violations []SchemaViolation
+	add := func(format string, args ...any) {
+		violations = append(violations, SchemaViolation{Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+	}
+
+	s, ok := schema.(map[string]any)
+	if !ok {
+		if schema == false {
+			add("no value is allowed here")
+		}
+		return violations
+	}
+
+	if ref, ok := s["$ref"].(string); ok {
+		if refDepth >= maxSchemaRefDepth {
+			add("too many nested references to %s", ref)
+			return violations
+		}
+		target, _ := v.resolveRef(ref)
+		violations = append(violations, v.validate(target, value, pointer, refDepth+1)...)
+	}
+
+	if kind, found := s["type"]; found && !matchesType(kind, value) {
+		// The other keywords would only repeat the problem
+		add("expected %s, got %s", describeTypes(kind), jsonType(value))
+		return violations
+	}
+	if enum, ok := s["enum"].([]any); ok {
+		matched := false
+		for _, allowed := range enum {
+			matched = matched || jsonEqual(allowed, value)
+		}
+		if !matched {
+			add("value must be one of %s", encodeSchemaValue(enum))
+		}
+	}
+	if constant, found := s["const"]; found && !jsonEqual(constant, value) {
+		add("value must be %s", encodeSchemaValue(constant))
+	}
+
+	if number, ok := numberValue(value); ok {
+		if limit, ok := s["minimum"].(float64); ok && number < limit {
+			add("%v is less than the minimum of %v", number, limit)
+		}
+		if limit, ok := s["maximum"].(float64); ok && number > limit {
+			add("%v is greater than the maximum of %v", number, limit)
+		}
+		if limit, ok := s["exclusiveMinimum"].(float64); ok && number <= limit {
+			add("%v must be greater than %v", number, limit)
+		}
+		if limit, ok := s["exclusiveMaximum"].(float64); ok && number >= limit {
+			add("%v must be less than %v", number, limit)
+		}
+		if divisor, ok := s["multipleOf"].(float64); ok && divisor > 0 {
+			quotient := number / divisor
+			if math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+				add("%v is not a multiple of %v", number, divisor)
+			}
+		}
+	}
+
+	if str, ok := stringValue(value); ok {
+		length := float64(utf8.RuneCountInString(str))
+		if limit, ok := s["minLength"].(float64); ok && length < limit {
+			add("string is shorter than the minimum length of %v", limit)
+		}
+		if limit, ok := s["maxLength"].(float64); ok && length > limit {
+			add("string is longer than the maximum length of %v", limit)
+		}
+		if pattern, ok := s["pattern"].(string); ok && !v.patterns[pattern].MatchString(str) {
+			add("string doesn't match the pattern %s", pattern)
+		}
+	}
+
+	switch val := value.(type) {
+	case []any:
+		violations = append(violations, v.validateArray(s, val, pointer)...)
+	case *orderedmap.OrderedMap[string, any]:
+		violations = append(violations, v.validateObject(s, val, pointer)...)
+	}
+
+	if allOf, ok := s["allOf"].([]any); ok {
+		for _, sub := range allOf {
+			violations = append(violations, v.validate(sub, value, pointer, refDepth)...)
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]any); ok && v.countMatches(anyOf, value, pointer, refDepth) == 0 {
+		add("value doesn't match any of the anyOf schemas")
+	}
+	if oneOf, ok := s["oneOf"].([]any); ok {
+		if matches := v.countMatches(oneOf, value, pointer, refDepth); matches != 1 {
+			add("value matches %d of the oneOf schemas, expected exactly one", matches)
+		}
+	}
+	if not, found := s["not"]; found && len(v.validate(not, value, pointer, refDepth)) == 0 {
+		add("value must not match the schema in not")
+	}
+	if condition, found := s["if"]; found {
+		if len(v.validate(condition, value, pointer, refDepth)) == 0 {
+			if then, found := s["then"]; found {
+				violations = append(violations, v.validate(then, value, pointer, refDepth)...)
+			}
+		} else if otherwise, found := s["else"]; found {
+			violations = append(violations, v.validate(otherwise, value, pointer, refDepth)...)
+		}
+	}
+	return violations
+}
+
+// validateArray checks the array keywords of a schema
+func (v *outputValidator) validateArray(s map[string]any, list []any, pointer string) []SchemaViolation {
+	var violations []SchemaViolation
+	add := func(format string, args ...any) {
+		violations = append(violations, SchemaViolation{Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+	}
+
+	length := float64(len(list))
+	if limit, ok := s["minItems"].(float64); ok && length < limit {
+		add("array has fewer than the minimum of %v items", limit)
+	}
+	if limit, ok := s["maxItems"].(float64); ok && length > limit {
+		add("array has more than the maximum of %v items", limit)
+	}
+	if unique, ok := s["uniqueItems"].(bool); ok && unique {
+		for i := range list {
+			for j := i + 1; j < len(list); j++ {
+				if jsonEqual(list[i], list[j]) {
+					add("items %d and %d are the same", i, j)
+				}
+			}
+		}
+	}
+
+	prefixItems, _ := s["prefixItems"].([]any)
+	items, hasItems := s["items"]
+	for i, item := range list {
+		itemPointer := pointer + "/" + fmt.Sprint(i)
+		switch {
+		case i < len(prefixItems):
+			violations = append(violations, v.validate(prefixItems[i], item, itemPointer, 0)...)
+		case hasItems:
+			violations = append(violations, v.validate(items, item, itemPointer, 0)...)
+		}
+	}
+	return violations
+}
+
+// validateObject checks the object keywords of a schema
+func (v *outputValidator) validateObject(s map[string]any, obj *orderedmap.OrderedMap[string, any], pointer string) []SchemaViolation {
+	var violations []SchemaViolation
+	add := func(format string, args ...any) {
+		violations = append(violations, SchemaViolation{Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+	}
+
+	count := float64(obj.Len())
+	if limit, ok := s["minProperties"].(float64); ok && count < limit {
+		add("object has fewer than the minimum of %v properties", limit)
+	}
+	if limit, ok := s["maxProperties"].(float64); ok && count > limit {
+		add("object has more than the maximum of %v properties", limit)
+	}
+	if required, ok := s["required"].([]any); ok {
+		for _, name := range required {
+			if nameStr, ok := name.(string); ok {
+				if _, found := obj.Get(nameStr); !found {
+					add("missing required property %s", nameStr)
+				}
+			}
+		}
+	}
+
+	properties, _ := s["properties"].(map[string]any)
+	patternProperties, _ := s["patternProperties"].(map[string]any)
+	additional, hasAdditional := s["additionalProperties"]
+
+	// Patterns are checked in a stable order so that violations are reported consistently
+	patterns := make([]string, 0, len(patternProperties))
+	for pattern := range patternProperties {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	for pair := obj.Oldest(); pair != nil; pair = pair.Next() {
+		propertyPointer := pointer + "/" + escapePointerSegment(pair.Key)
+		matched := false
+		if propertySchema, found := properties[pair.Key]; found {
+			matched = true
+			violations = append(violations, v.validate(propertySchema, pair.Value, propertyPointer, 0)...)
+		}
+		for _, pattern := range patterns {
+			if v.patterns[pattern].MatchString(pair.Key) {
+				matched = true
+				violations = append(violations, v.validate(patternProperties[pattern], pair.Value, propertyPointer, 0)...)
+			}
+		}
+		if matched || !hasAdditional {
+			continue
+		}
+		if additional == false {
+			violations = append(violations, SchemaViolation{Pointer: propertyPointer, Message: "property is not allowed"})
+			continue
+		}
+		violations = append(violations, v.validate(additional, pair.Value, propertyPointer, 0)...)
+	}
+	return violations
+}
+
+// countMatches returns how many of the schemas value matches
+func (v *outputValidator) countMatches(schemas []any, value any, pointer string, refDepth int) int {
+	matches := 0
+	for _, sub := range schemas {
+		if len(v.validate(sub, value, pointer, refDepth)) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+// jsonType returns the JSON Schema type of a normalized output value
+func jsonType(value any) string {
+	switch val := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case int64, uint64, time.Duration:
+		return "integer"
+	case float64:
+		if val == math.Trunc(val) && !math.IsInf(val, 0) {
+			return "integer"
+		}
+		return "number"
+	case string, []byte, time.Time:
+		return "string"
+	case []any:
+		return "array"
+	case *orderedmap.OrderedMap[string, any]:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// matchesType reports whether value has one of the types given by a type keyword
+func matchesType(kind any, value any) bool {
+	valueType := jsonType(value)
+	matches := func(k any) bool {
+		return k == valueType || (k == "number" && valueType == "integer")
+	}
+
+	if kinds, ok := kind.([]any); ok {
+		for _, k := range kinds {
+			if matches(k) {
+				return true
+			}
+		}
+		return false
+	}
+	return matches(kind)
+}
+
+// describeTypes describes the value of a type keyword, e.g. string or null
+func describeTypes(kind any) string {
+	if kinds, ok := kind.([]any); ok {
+		names := make([]string, 0, len(kinds))
+		for _, k := range kinds {
+			names = append(names, fmt.Sprint(k))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(kind)
+}
+
+// numberValue returns a numeric output value as a float64
+func numberValue(value any) (float64, bool) {
+	switch val := value.(type) {
+	case int64:
+		return float64(val), true
+	case uint64:
+		return float64(val), true
+	case float64:
+		return val, true
+	case time.Duration:
+		return float64(val), true
+	}
+	return 0, false
+}
+
+// stringValue returns an output value that is encoded as a JSON string as that string
+func stringValue(value any) (string, bool) {
+	switch val := value.(type) {
+	case string:
+		return val, true
+	case []byte, time.Time:
+		var str string
+		encoded, _ := json.Marshal(val)
+		return str, json.Unmarshal(encoded, &str) == nil
+	}
+	return "", false
+}
+
+// jsonEqual reports whether two values are the same once encoded as JSON, ignoring the order of object keys
+func jsonEqual(a, b any) bool {
+	return reflect.DeepEqual(asPlainJson(a), asPlainJson(b))
+}
+
+func asPlainJson(value any) any {
+	var plain any
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	_ = json.Unmarshal(encoded, &plain)
+	return plain
+}
+
+func encodeSchemaValue(value any) string {
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
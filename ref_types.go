@@ -0,0 +1,186 @@
+package celjsontemplates
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/google/cel-go/cel"
+)
+
+// refTypeInference derives CEL types from the reference data
+type refTypeInference struct {
+	provider *structTypeProvider
+}
+
+// inferRefType returns the CEL type of the reference data. The top level is always a struct so that
+// unknown names are reported, nested maps whose values share a type are maps (such as lookup tables)
+// and other nested maps are structs.
+func inferRefType(ref map[string]interface{}, provider *structTypeProvider) *cel.Type {
+	r := &refTypeInference{provider: provider}
+
+	if !hasIdentifierKeys(reflect.ValueOf(ref)) {
+		return r.infer([]reflect.Value{reflect.ValueOf(ref)}, structTypePrefix+"ref")
+	}
+	return r.inferStruct([]reflect.Value{reflect.ValueOf(ref)}, structTypePrefix+"ref")
+}
+
+// infer returns a CEL type that describes all of the sample values, or dyn if they don't share a type
+func (r *refTypeInference) infer(samples []reflect.Value, name string) *cel.Type {
+	var values []reflect.Value
+	hasNull := false
+	for _, sample := range samples {
+		sample = indirect(sample)
+		if !sample.IsValid() {
+			hasNull = true
+			continue
+		}
+		values = append(values, sample)
+	}
+	if len(values) == 0 {
+		if hasNull {
+			return cel.NullType
+		}
+		return cel.DynType
+	}
+
+	kind := refKind(values[0])
+	for _, value := range values[1:] {
+		if refKind(value) != kind {
+			return cel.DynType
+		}
+	}
+
+	var celType *cel.Type
+	switch kind {
+	case reflect.Bool:
+		celType = cel.BoolType
+	case reflect.Int:
+		celType = cel.IntType
+	case reflect.Uint:
+		celType = cel.UintType
+	case reflect.Float64:
+		celType = cel.DoubleType
+	case reflect.String:
+		celType = cel.StringType
+	case reflect.Slice:
+		var items []reflect.Value
+		for _, value := range values {
+			for i := 0; i < value.Len(); i++ {
+				items = append(items, value.Index(i))
+			}
+		}
+		celType = cel.ListType(r.infer(items, name+".item"))
+	case reflect.Map:
+		celType = r.inferMap(values, name)
+	default:
+		return cel.DynType
+	}
+
+	if hasNull {
+		switch kind {
+		case reflect.Bool, reflect.Int, reflect.Uint, reflect.Float64, reflect.String:
+			return cel.NullableType(celType)
+		case reflect.Map:
+			if celType.Kind() != cel.StructKind {
+				return cel.DynType
+			}
+		default:
+			return cel.DynType
+		}
+	}
+	return celType
+}
+
+// inferMap returns a map type if the values of the sample maps share a type, otherwise a struct type
+func (r *refTypeInference) inferMap(samples []reflect.Value, name string) *cel.Type {
+	var keys, values []reflect.Value
+	for _, sample := range samples {
+		iter := sample.MapRange()
+		for iter.Next() {
+			keys = append(keys, iter.Key())
+			values = append(values, iter.Value())
+		}
+	}
+
+	keyType := r.infer(keys, name+".key")
+	valueType := r.infer(values, name+".value")
+	if valueType != cel.DynType || keyType != cel.StringType {
+		return cel.MapType(keyType, valueType)
+	}
+
+	for _, sample := range samples {
+		if !hasIdentifierKeys(sample) {
+			return cel.MapType(keyType, valueType)
+		}
+	}
+	return r.inferStruct(samples, name)
+}
+
+// inferStruct declares a struct type with a field for each key of the sample maps
+func (r *refTypeInference) inferStruct(samples []reflect.Value, name string) *cel.Type {
+	fieldSamples := make(map[string][]reflect.Value)
+	for _, sample := range samples {
+		iter := sample.MapRange()
+		for iter.Next() {
+			field := fmt.Sprint(iter.Key().Interface())
+			fieldSamples[field] = append(fieldSamples[field], iter.Value())
+		}
+	}
+
+	fieldNames := make([]string, 0, len(fieldSamples))
+	for field := range fieldSamples {
+		fieldNames = append(fieldNames, field)
+	}
+	sort.Strings(fieldNames)
+
+	fields := make(map[string]*cel.Type, len(fieldNames))
+	for _, field := range fieldNames {
+		fields[field] = r.infer(fieldSamples[field], name+"."+field)
+	}
+	return r.provider.addStruct(name, fields)
+}
+
+// refKind groups Go kinds by the CEL type they are converted to
+func refKind(value reflect.Value) reflect.Kind {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflect.Int
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return reflect.Uint
+	case reflect.Float32, reflect.Float64:
+		return reflect.Float64
+	case reflect.Array, reflect.Slice:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			// Bytes aren't inferred
+			return reflect.Invalid
+		}
+		return reflect.Slice
+	}
+	return value.Kind()
+}
+
+// indirect removes any interfaces and pointers around a value
+func indirect(value reflect.Value) reflect.Value {
+	for value.IsValid() && (value.Kind() == reflect.Interface || value.Kind() == reflect.Pointer) {
+		if value.IsNil() {
+			return reflect.Value{}
+		}
+		value = value.Elem()
+	}
+	return value
+}
+
+// hasIdentifierKeys reports whether all the keys of a map can be used as CEL field names
+func hasIdentifierKeys(value reflect.Value) bool {
+	if value.Type().Key().Kind() != reflect.String {
+		return false
+	}
+	iter := value.MapRange()
+	for iter.Next() {
+		if !celIdentifier.MatchString(iter.Key().String()) {
+			return false
+		}
+	}
+	return true
+}
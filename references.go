@@ -0,0 +1,217 @@
+package celjsontemplates
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+)
+
+// Reference is a use of the input data or reference data by a template
+type Reference struct {
+	// Path is the field that is accessed, e.g. data.items[*].price or ref.countries["GB"].
+	// List items that aren't selected with a constant index are written as [*].
+	Path string
+	// Template is the JSON pointer of the template value using it, prefixed with the fragment
+	// name for fragments, e.g. #/total or row#/price
+	Template string
+}
+
+func (t *celTemplate) References() []Reference {
+	var references []Reference
+	t.walkExpressions(func(location string, expr *templateExpression) {
+		for _, path := range accessedPaths(expr.ast.NativeRep().Expr(), map[string]string{"data": "data", "ref": "ref"}) {
+			references = append(references, Reference{Path: path, Template: location})
+		}
+	})
+	return references
+}
+
+// walkExpressions calls visit for every expression in the template and its fragments, with the
+// location of the expression in the same form as SchemaViolation.Template. Fragments are visited
+// after the template in name order.
+func (t *celTemplate) walkExpressions(visit func(location string, expr *templateExpression)) {
+	for _, req := range t.requirements {
+		visit("#/"+requireKey+"/"+escapePointerSegment(req.expr.source), req.expr)
+	}
+	walkNodeExpressions(t.compiledTemplate, "#", visit)
+
+	names := make([]string, 0, len(t.compiledFragments))
+	for name := range t.compiledFragments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		walkNodeExpressions(t.compiledFragments[name].body, name+"#", visit)
+	}
+}
+
+func walkNodeExpressions(node any, location string, visit func(location string, expr *templateExpression)) {
+	switch val := node.(type) {
+	case *templateExpression:
+		visit(location, val)
+	case *orderedmap.OrderedMap[string, any]:
+		for pair := val.Oldest(); pair != nil; pair = pair.Next() {
+			if lets, ok := pair.Value.(*letBindings); ok {
+				for i, name := range lets.names {
+					visit(location+"/"+letKey+"/"+escapePointerSegment(name), lets.values[i])
+				}
+				continue
+			}
+			walkNodeExpressions(pair.Value, location+"/"+escapePointerSegment(templateKey(pair.Key, pair.Value)), visit)
+		}
+	case []any:
+		for i, item := range val {
+			walkNodeExpressions(item, location+"/"+strconv.Itoa(i), visit)
+		}
+	}
+}
+
+// accessedPaths returns the data and ref fields used by an expression, sorted and without duplicates.
+// variables maps the identifiers that refer to fields, such as data, to their paths. Comprehension
+// variables that range over a field are followed, so i.price in data.items.map(i, i.price) is
+// reported as data.items[*].price.
+func accessedPaths(e ast.Expr, variables map[string]string) []string {
+	found := make(map[string]bool)
+	collectPaths(e, variables, found)
+
+	paths := make([]string, 0, len(found))
+	for path := range found {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// collectPaths adds the fields used by e to found. Identifiers mapped to an empty path in variables
+// don't refer to a field.
+func collectPaths(e ast.Expr, variables map[string]string, found map[string]bool) {
+	if path, ok := fieldPath(e, variables); ok {
+		found[path] = true
+		// Only the index expressions within the path can use other fields
+		collectIndexPaths(e, variables, found)
+		return
+	}
+
+	switch e.Kind() {
+	case ast.ComprehensionKind:
+		comp := e.AsComprehension()
+		collectPaths(comp.IterRange(), variables, found)
+		collectPaths(comp.AccuInit(), variables, found)
+
+		loopVariables := make(map[string]string, len(variables)+2)
+		for name, path := range variables {
+			loopVariables[name] = path
+		}
+		loopVariables[comp.AccuVar()] = ""
+		loopVariables[comp.IterVar()] = ""
+		if rangePath, ok := fieldPath(comp.IterRange(), variables); ok {
+			loopVariables[comp.IterVar()] = rangePath + "[*]"
+		}
+		collectPaths(comp.LoopCondition(), loopVariables, found)
+		collectPaths(comp.LoopStep(), loopVariables, found)
+		collectPaths(comp.Result(), loopVariables, found)
+	case ast.SelectKind:
+		collectPaths(e.AsSelect().Operand(), variables, found)
+	case ast.CallKind:
+		call := e.AsCall()
+		if call.IsMemberFunction() {
+			collectPaths(call.Target(), variables, found)
+		}
+		for _, arg := range call.Args() {
+			collectPaths(arg, variables, found)
+		}
+	case ast.ListKind:
+		for _, elem := range e.AsList().Elements() {
+			collectPaths(elem, variables, found)
+		}
+	case ast.MapKind:
+		for _, entry := range e.AsMap().Entries() {
+			collectPaths(entry.AsMapEntry().Key(), variables, found)
+			collectPaths(entry.AsMapEntry().Value(), variables, found)
+		}
+	case ast.StructKind:
+		for _, field := range e.AsStruct().Fields() {
+			collectPaths(field.AsStructField().Value(), variables, found)
+		}
+	}
+}
+
+// collectIndexPaths adds the fields used by the index expressions of a field path
+func collectIndexPaths(e ast.Expr, variables map[string]string, found map[string]bool) {
+	switch e.Kind() {
+	case ast.SelectKind:
+		collectIndexPaths(e.AsSelect().Operand(), variables, found)
+	case ast.CallKind:
+		args := e.AsCall().Args()
+		collectIndexPaths(args[0], variables, found)
+		if e.AsCall().FunctionName() != operators.OptSelect {
+			collectPaths(args[1], variables, found)
+		}
+	}
+}
+
+// fieldPath returns the path of the field selected by e, if e selects a field of the data or reference data.
+// has() tests and optional selection and indexing are treated as accessing the field.
+func fieldPath(e ast.Expr, variables map[string]string) (string, bool) {
+	switch e.Kind() {
+	case ast.IdentKind:
+		path := variables[e.AsIdent()]
+		return path, path != ""
+	case ast.SelectKind:
+		sel := e.AsSelect()
+		path, ok := fieldPath(sel.Operand(), variables)
+		if !ok {
+			return "", false
+		}
+		return path + fieldSegment(sel.FieldName()), true
+	case ast.CallKind:
+		call := e.AsCall()
+		if call.IsMemberFunction() || len(call.Args()) != 2 {
+			return "", false
+		}
+		switch call.FunctionName() {
+		case operators.Index, operators.OptIndex, operators.OptSelect:
+		default:
+			return "", false
+		}
+		// Items of a list variable can also refer to fields, such as the arguments of a fragment
+		operand, index := call.Args()[0], call.Args()[1]
+		if operand.Kind() == ast.IdentKind && index.Kind() == ast.LiteralKind {
+			if path := variables[operand.AsIdent()+indexSegment(index)]; path != "" {
+				return path, true
+			}
+		}
+		path, ok := fieldPath(operand, variables)
+		if !ok {
+			return "", false
+		}
+		return path + indexSegment(index), true
+	}
+	return "", false
+}
+
+// fieldSegment returns the path segment for selecting a field
+func fieldSegment(name string) string {
+	if celIdentifier.MatchString(name) {
+		return "." + name
+	}
+	return "[" + strconv.Quote(name) + "]"
+}
+
+// indexSegment returns the path segment for an index, using [*] unless the index is a constant
+func indexSegment(index ast.Expr) string {
+	if index.Kind() == ast.LiteralKind {
+		switch key := index.AsLiteral().(type) {
+		case types.String:
+			return fieldSegment(string(key))
+		case types.Int, types.Uint:
+			return "[" + fmt.Sprint(key.Value()) + "]"
+		}
+	}
+	return "[*]"
+}
@@ -0,0 +1,127 @@
+package celjsontemplates
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/buger/jsonparser"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+)
+
+// requireKey is the top level template key that lists the preconditions on the input data
+const requireKey = "$require"
+
+// requirement is a precondition from the $require block
+type requirement struct {
+	expr    *templateExpression
+	message string
+}
+
+// RequirementFailure describes a $require precondition that the data doesn't meet
+type RequirementFailure struct {
+	// Expression is the CEL expression of the precondition
+	Expression string
+	// Message is the message given for the precondition
+	Message string
+	// Err holds the error if the expression couldn't be evaluated, for example because of a missing key
+	Err error
+}
+
+func (f RequirementFailure) String() string {
+	if f.Err != nil {
+		return fmt.Sprintf("%s (%v)", f.Message, f.Err)
+	}
+	return f.Message
+}
+
+// RequirementError is returned by Expand when the data doesn't meet the $require preconditions of
+// the template. It lists every precondition that failed.
+type RequirementError struct {
+	Failures []RequirementFailure
+}
+
+func (e *RequirementError) Error() string {
+	messages := make([]string, 0, len(e.Failures))
+	for _, failure := range e.Failures {
+		messages = append(messages, failure.String())
+	}
+	return "data doesn't meet the template requirements: " + strings.Join(messages, "; ")
+}
+
+// parseRequirements compiles the $require block of a template, if it has one.
+// Each key is a CEL expression that must be true and each value the message used when it isn't.
+func parseRequirements(env *templateEnv, jsonTemplate []byte, scope *outputScope) ([]*requirement, error) {
+	requireData, requireType, _, err := jsonparser.Get(jsonTemplate, requireKey)
+	if err != nil {
+		return nil, nil
+	}
+	if requireType != jsonparser.Object {
+		return nil, fmt.Errorf("%s must be an object of expressions and messages", requireKey)
+	}
+
+	var requirements []*requirement
+	err = jsonparser.ObjectEach(requireData,
+		func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+			source := string(key)
+			if dataType != jsonparser.String {
+				return fmt.Errorf("%s: the message for %s must be a string", requireKey, source)
+			}
+			message, err := jsonparser.ParseString(value)
+			if err != nil {
+				return fmt.Errorf("%s: %s: %w", requireKey, source, err)
+			}
+
+			expr, err := compileExpression(env, source, missingKeysDefault)
+			if err != nil {
+				return fmt.Errorf("%s: %s: %w", requireKey, source, err)
+			}
+			// No output has been computed when the preconditions are checked
+			if err := scope.check(expr.ast); err != nil {
+				return fmt.Errorf("%s: %s: %w", requireKey, source, err)
+			}
+			outputType := expr.ast.OutputType()
+			if outputType != cel.BoolType && outputType != cel.DynType {
+				return fmt.Errorf("%s: %s must be a bool expression, not %s", requireKey, source, outputType)
+			}
+
+			requirements = append(requirements, &requirement{expr: expr, message: message})
+			return nil
+		})
+
+	if err != nil {
+		return nil, err
+	}
+	return requirements, nil
+}
+
+// checkRequirements evaluates every $require precondition, returning a RequirementError listing
+// those that aren't met. Expressions that can't be evaluated count as failed, although the fail
+// function still stops the expansion.
+func (t *celTemplate) checkRequirements(input map[string]any) error {
+	var failures []RequirementFailure
+	for _, req := range t.requirements {
+		out, err := req.expr.eval(input)
+		if err != nil {
+			var failure *TemplateFailure
+			if errors.As(err, &failure) {
+				return failure
+			}
+			failures = append(failures, RequirementFailure{Expression: req.expr.source, Message: req.message, Err: err})
+			continue
+		}
+
+		if out != types.True {
+			if _, isBool := out.(types.Bool); !isBool {
+				err = fmt.Errorf("expected a bool, got %s", out.Type().TypeName())
+			}
+			failures = append(failures, RequirementFailure{Expression: req.expr.source, Message: req.message, Err: err})
+		}
+	}
+
+	if len(failures) > 0 {
+		return &RequirementError{Failures: failures}
+	}
+	return nil
+}
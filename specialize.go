@@ -0,0 +1,242 @@
+package celjsontemplates
+
+import (
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/interpreter"
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+)
+
+func (t *celTemplate) Specialize(partialData map[string]interface{}) (Template, error) {
+	var known any = partialData
+	if t.dataSchema != nil {
+		known = t.dataSchema.coerce(known)
+	}
+	// Data given to an earlier call of Specialize is also known
+	known = mergeData(t.partialData, known)
+	s := &specializer{t: t, known: known.(map[string]any)}
+
+	specialized := *t
+	specialized.partialData = s.known
+
+	specialized.requirements = make([]*requirement, 0, len(t.requirements))
+	for _, req := range t.requirements {
+		expr, err := s.expression(req.expr)
+		if err != nil {
+			return nil, err
+		}
+		// Failures are reported with the precondition as it was written
+		expr.source = req.expr.source
+		specialized.requirements = append(specialized.requirements, &requirement{expr: expr, message: req.message})
+	}
+
+	body, err := s.node(t.compiledTemplate)
+	if err != nil {
+		return nil, err
+	}
+	specialized.compiledTemplate = body.(*orderedmap.OrderedMap[string, any])
+
+	specialized.compiledFragments = make(map[string]*compiledFragment, len(t.compiledFragments))
+	for name, cf := range t.compiledFragments {
+		body, err := s.node(cf.body)
+		if err != nil {
+			return nil, err
+		}
+		specialized.compiledFragments[name] = &compiledFragment{params: cf.params, body: body.(*orderedmap.OrderedMap[string, any])}
+	}
+	return &specialized, nil
+}
+
+// specializer evaluates as much of a template as possible with part of the data
+type specializer struct {
+	t *celTemplate
+	// known holds the top level data keys that are known
+	known map[string]any
+}
+
+// node returns a copy of a compiled template value with its expressions specialized
+func (s *specializer) node(node any) (any, error) {
+	switch val := node.(type) {
+	case *templateExpression:
+		return s.expression(val)
+	case *orderedmap.OrderedMap[string, any]:
+		result := orderedmap.New[string, any]()
+		for pair := val.Oldest(); pair != nil; pair = pair.Next() {
+			if lets, ok := pair.Value.(*letBindings); ok {
+				specializedLets := &letBindings{names: lets.names}
+				for _, value := range lets.values {
+					expr, err := s.expression(value)
+					if err != nil {
+						return nil, err
+					}
+					specializedLets.values = append(specializedLets.values, expr)
+				}
+				result.Set(pair.Key, specializedLets)
+				continue
+			}
+
+			value, err := s.node(pair.Value)
+			if err != nil {
+				return nil, err
+			}
+			result.Set(pair.Key, value)
+		}
+		return result, nil
+	case []any:
+		result := make([]any, 0, len(val))
+		for _, item := range val {
+			value, err := s.node(item)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, value)
+		}
+		return result, nil
+	}
+	return node, nil
+}
+
+// expression partially evaluates an expression, treating everything other than the known data and
+// ref as unknown. Expressions that can be evaluated become constants, others are replaced by the
+// residual expression left after evaluating what is known.
+func (s *specializer) expression(expr *templateExpression) (*templateExpression, error) {
+	// Functions added with WithCelOptions may not give the same result each time
+	if expr.constant != nil || !callsFoldableOverloads(expr.ast) {
+		return expr, nil
+	}
+
+	prg, err := expr.env.Program(expr.ast, cel.EvalOptions(cel.OptPartialEval, cel.OptTrackState))
+	if err != nil {
+		return nil, err
+	}
+	vars, err := cel.PartialVars(map[string]any{"data": s.known, "ref": s.t.ref}, s.unknowns(expr.ast.NativeRep().Expr())...)
+	if err != nil {
+		return nil, err
+	}
+
+	out, details, err := prg.Eval(vars)
+	if err != nil {
+		// Failures such as missing keys are left to be handled when the template is expanded
+		return expr, nil
+	}
+
+	residual, err := expr.env.ResidualAst(expr.ast, details)
+	if err != nil {
+		// The value can't be written as an expression, such as a map from the data
+		if types.IsUnknown(out) {
+			return expr, nil
+		}
+		residual = expr.ast
+	}
+	source, err := cel.AstToString(residual)
+	if err != nil {
+		return nil, err
+	}
+
+	specialized, err := compileChecked(expr.env, source, residual, expr.missingKeys)
+	if err != nil {
+		return nil, err
+	}
+	if !types.IsUnknown(out) {
+		specialized.constant = out
+	}
+	return specialized, nil
+}
+
+// unknowns returns the attribute patterns for everything an expression uses that isn't known:
+// data keys that weren't given and all variables other than data and ref. ref is also unknown when
+// constant folding is turned off, as the reference data may be changed after the template is created.
+func (s *specializer) unknowns(e ast.Expr) []*interpreter.AttributePattern {
+	var patterns []*interpreter.AttributePattern
+	for name := range freeVariables(e) {
+		if name == "data" || (name == "ref" && !s.t.noConstantFolding) {
+			continue
+		}
+		patterns = append(patterns, cel.AttributePattern(name))
+	}
+
+	keys, wholeData := dataKeys(e)
+	if wholeData {
+		// data is used in a way that doesn't name the key, so none of it can be relied on
+		return append(patterns, cel.AttributePattern("data"))
+	}
+	for key := range keys {
+		if _, found := s.known[key]; !found {
+			patterns = append(patterns, cel.AttributePattern("data").QualString(key))
+		}
+	}
+	return patterns
+}
+
+// dataKeys returns the top level data keys used by an expression, and whether data is used in any
+// other way, such as with an index that isn't a constant
+func dataKeys(e ast.Expr) (map[string]bool, bool) {
+	keys := make(map[string]bool)
+	uses, named := 0, 0
+	visitExpr(e, func(e ast.Expr) {
+		switch e.Kind() {
+		case ast.IdentKind:
+			if e.AsIdent() == "data" {
+				uses++
+			}
+		case ast.SelectKind:
+			sel := e.AsSelect()
+			if isDataIdent(sel.Operand()) {
+				keys[sel.FieldName()] = true
+				named++
+			}
+		case ast.CallKind:
+			call := e.AsCall()
+			switch call.FunctionName() {
+			case operators.Index, operators.OptIndex, operators.OptSelect:
+			default:
+				return
+			}
+			args := call.Args()
+			if len(args) != 2 || !isDataIdent(args[0]) || args[1].Kind() != ast.LiteralKind {
+				return
+			}
+			if key, ok := args[1].AsLiteral().(types.String); ok {
+				keys[string(key)] = true
+				named++
+			}
+		}
+	})
+	return keys, uses != named
+}
+
+func isDataIdent(e ast.Expr) bool {
+	return e.Kind() == ast.IdentKind && e.AsIdent() == "data"
+}
+
+// mergeData adds the data given to Specialize to the data passed to Expand. The specialized data
+// takes precedence as expressions using it have already been evaluated.
+func mergeData(partialData map[string]any, data any) any {
+	if len(partialData) == 0 {
+		return data
+	}
+
+	switch val := data.(type) {
+	case map[string]any:
+		merged := make(map[string]any, len(val)+len(partialData))
+		for key, value := range val {
+			merged[key] = value
+		}
+		for key, value := range partialData {
+			merged[key] = value
+		}
+		return merged
+	case *orderedmap.OrderedMap[string, any]:
+		merged := orderedmap.New[string, any]()
+		for pair := val.Oldest(); pair != nil; pair = pair.Next() {
+			merged.Set(pair.Key, pair.Value)
+		}
+		for key, value := range partialData {
+			merged.Set(key, value)
+		}
+		return merged
+	}
+	return data
+}
@@ -0,0 +1,87 @@
+package celjsontemplates
+
+import (
+	"sort"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// structTypePrefix is used for the names of the struct types generated by the library
+const structTypePrefix = "celjsontemplates."
+
+// structTypeProvider adds struct types, described by their field types, to the standard CEL types.
+// Values of these types are still maps when the template is expanded, the struct types allow the
+// checker to report unknown fields and type mismatches when the template is compiled.
+type structTypeProvider struct {
+	*types.Registry
+	structs map[string]map[string]*types.Type
+}
+
+func newStructTypeProvider() (*structTypeProvider, error) {
+	registry, err := types.NewRegistry()
+	if err != nil {
+		return nil, err
+	}
+	return &structTypeProvider{
+		Registry: registry,
+		structs:  make(map[string]map[string]*types.Type),
+	}, nil
+}
+
+// addStruct declares a struct type with the given fields, returning the type
+func (p *structTypeProvider) addStruct(name string, fields map[string]*types.Type) *types.Type {
+	p.structs[name] = fields
+	return types.NewObjectType(name)
+}
+
+// FindStructType implements types.Provider
+func (p *structTypeProvider) FindStructType(structType string) (*types.Type, bool) {
+	if _, found := p.structs[structType]; found {
+		return types.NewTypeTypeWithParam(types.NewObjectType(structType)), true
+	}
+	return p.Registry.FindStructType(structType)
+}
+
+// FindStructFieldNames implements types.Provider
+func (p *structTypeProvider) FindStructFieldNames(structType string) ([]string, bool) {
+	fields, found := p.structs[structType]
+	if !found {
+		return p.Registry.FindStructFieldNames(structType)
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// FindStructFieldType implements types.Provider
+func (p *structTypeProvider) FindStructFieldType(structType, fieldName string) (*types.FieldType, bool) {
+	fields, found := p.structs[structType]
+	if !found {
+		return p.Registry.FindStructFieldType(structType, fieldName)
+	}
+	fieldType, found := fields[fieldName]
+	if !found {
+		return nil, false
+	}
+	return &types.FieldType{Type: fieldType}, true
+}
+
+// FindIdent implements types.Provider
+func (p *structTypeProvider) FindIdent(identName string) (ref.Val, bool) {
+	if _, found := p.structs[identName]; found {
+		return types.NewObjectType(identName), true
+	}
+	return p.Registry.FindIdent(identName)
+}
+
+// NewValue implements types.Provider
+func (p *structTypeProvider) NewValue(structType string, fields map[string]ref.Val) ref.Val {
+	if _, found := p.structs[structType]; found {
+		return types.NewErr("values of type '%s' can't be created", structType)
+	}
+	return p.Registry.NewValue(structType, fields)
+}
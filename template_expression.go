@@ -0,0 +1,238 @@
+package celjsontemplates
+
+import (
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+const (
+	// optionalKeyMarker ends a key whose expression never fails because of missing keys
+	optionalKeyMarker = "?"
+	// requiredKeyMarker ends a key whose expression always fails because of missing keys
+	requiredKeyMarker = "!"
+)
+
+// missingKeyMode controls how an expression that refers to a missing key is handled
+type missingKeyMode int
+
+const (
+	// missingKeysDefault follows the WithMissingKeyErrors option
+	missingKeysDefault missingKeyMode = iota
+	// missingKeysOptional removes the property
+	missingKeysOptional
+	// missingKeysRequired stops the expansion
+	missingKeysRequired
+)
+
+// templateExpression is a compiled CEL expression from the template
+type templateExpression struct {
+	// source holds the CEL expression as written in the template
+	source string
+	// ast holds the checked expression
+	ast *cel.Ast
+	// env is the environment the expression was compiled in
+	env *cel.Env
+	// program runs the expression
+	program cel.Program
+	// missingKeys controls how missing keys are handled for this expression
+	missingKeys missingKeyMode
+	// constant holds the value of an expression that only depends on ref, once it has been folded
+	constant ref.Val
+	// shared holds the compiled program that is shared by every use of the expression
+	shared *compiledProgram
+}
+
+// eval runs the expression, using the folded value for constant expressions. Expressions that
+// only read data and ref are run once per expansion when memoization is enabled.
+func (e *templateExpression) eval(input map[string]any) (ref.Val, error) {
+	if e.constant != nil {
+		return e.constant, nil
+	}
+
+	if e.shared.dataOnly {
+		if ex, ok := input[expansionVariable].(*expansion); ok && ex.memo != nil {
+			// data and ref can't be redeclared, so the expression has the same result in the template and in fragments
+			if result, found := ex.memo[e.source]; found {
+				return result.value, result.err
+			}
+			out, _, err := e.program.Eval(input)
+			ex.memo[e.source] = memoResult{value: out, err: err}
+			return out, err
+		}
+	}
+
+	out, _, err := e.program.Eval(input)
+	return out, err
+}
+
+// templateEnv is the CEL environment that template expressions are compiled in. The environments
+// used for a template, its fragments and their $let variables share a cache, so each distinct
+// expression is compiled once per environment. Expressions that only read data and ref, which are
+// declared the same way in all of them, share one program for the whole template.
+type templateEnv struct {
+	*cel.Env
+	programs map[programKey]*compiledProgram
+}
+
+// programKey identifies an expression compiled in a particular environment. The environment is
+// nil for expressions that only read data and ref.
+type programKey struct {
+	env    *cel.Env
+	source string
+}
+
+// compiledProgram is a checked and planned expression, shared by every use of the expression
+type compiledProgram struct {
+	env     *cel.Env
+	ast     *cel.Ast
+	program cel.Program
+	// dataOnly is set for expressions that only read data and ref, so give the same result
+	// wherever they are used in an expansion
+	dataOnly bool
+}
+
+func newTemplateEnv(opts ...cel.EnvOption) (*templateEnv, error) {
+	env, err := cel.NewEnv(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &templateEnv{Env: env, programs: make(map[programKey]*compiledProgram)}, nil
+}
+
+// sibling returns a new environment with its own declarations that shares the program cache,
+// such as the environment for fragments. data and ref must be declared with the same types.
+func (e *templateEnv) sibling(opts ...cel.EnvOption) (*templateEnv, error) {
+	env, err := cel.NewEnv(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &templateEnv{Env: env, programs: e.programs}, nil
+}
+
+// extend returns an environment with additional declarations that shares the program cache
+func (e *templateEnv) extend(opts ...cel.EnvOption) (*templateEnv, error) {
+	env, err := e.Env.Extend(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &templateEnv{Env: env, programs: e.programs}, nil
+}
+
+// compile returns the compiled program for an expression, compiling it the first time it is seen
+func (e *templateEnv) compile(source string) (*compiledProgram, error) {
+	key := programKey{env: e.Env, source: source}
+	if compiled, found := e.programs[key]; found {
+		return compiled, nil
+	}
+
+	// Expressions are always checked in their own environment, even when the program is shared
+	checked, issues := e.Compile(source)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	sharedKey := programKey{source: source}
+	dataOnly := readsOnlyData(checked)
+	if compiled, found := e.programs[sharedKey]; found && dataOnly {
+		e.programs[key] = compiled
+		return compiled, nil
+	}
+
+	compiled, err := newCompiledProgram(e.Env, checked)
+	if err != nil {
+		return nil, err
+	}
+	e.programs[key] = compiled
+	if dataOnly {
+		e.programs[sharedKey] = compiled
+	}
+	return compiled, nil
+}
+
+// newCompiledProgram plans an expression that has already been checked
+func newCompiledProgram(env *cel.Env, ast *cel.Ast) (*compiledProgram, error) {
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	return &compiledProgram{env: env, ast: ast, program: prg, dataOnly: readsOnlyData(ast)}, nil
+}
+
+// readsOnlyData reports whether data and ref are the only variables an expression uses
+func readsOnlyData(ast *cel.Ast) bool {
+	for name := range freeVariables(ast.NativeRep().Expr()) {
+		if name != "data" && name != "ref" {
+			return false
+		}
+	}
+	return true
+}
+
+// compileExpression compiles and plans a CEL expression from the template. Expressions that
+// have already been compiled share the program.
+func compileExpression(env *templateEnv, source string, missingKeys missingKeyMode) (*templateExpression, error) {
+	compiled, err := env.compile(source)
+	if err != nil {
+		return nil, err
+	}
+	return newTemplateExpression(source, compiled, missingKeys), nil
+}
+
+// compileChecked plans an expression that has already been checked
+func compileChecked(env *cel.Env, source string, ast *cel.Ast, missingKeys missingKeyMode) (*templateExpression, error) {
+	compiled, err := newCompiledProgram(env, ast)
+	if err != nil {
+		return nil, err
+	}
+	return newTemplateExpression(source, compiled, missingKeys), nil
+}
+
+func newTemplateExpression(source string, compiled *compiledProgram, missingKeys missingKeyMode) *templateExpression {
+	return &templateExpression{
+		source:      source,
+		ast:         compiled.ast,
+		env:         compiled.env,
+		program:     compiled.program,
+		missingKeys: missingKeys,
+		shared:      compiled,
+	}
+}
+
+// parseKey strips any optional or required marker from a template key, returning the output key.
+// A doubled marker is output as a single marker character.
+func parseKey(key string) (string, missingKeyMode) {
+	for _, marker := range []string{optionalKeyMarker, requiredKeyMarker} {
+		if strings.HasSuffix(key, marker+marker) {
+			return strings.TrimSuffix(key, marker), missingKeysDefault
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(key, optionalKeyMarker):
+		return strings.TrimSuffix(key, optionalKeyMarker), missingKeysOptional
+	case strings.HasSuffix(key, requiredKeyMarker):
+		return strings.TrimSuffix(key, requiredKeyMarker), missingKeysRequired
+	}
+	return key, missingKeysDefault
+}
+
+// templateKey returns the key as written in the template for an output key, restoring any marker
+func templateKey(name string, node any) string {
+	if expr, ok := node.(*templateExpression); ok {
+		switch expr.missingKeys {
+		case missingKeysOptional:
+			return name + optionalKeyMarker
+		case missingKeysRequired:
+			return name + requiredKeyMarker
+		}
+	}
+
+	// Keys ending with a marker character were escaped by doubling it
+	for _, marker := range []string{optionalKeyMarker, requiredKeyMarker} {
+		if strings.HasSuffix(name, marker) {
+			return name + marker
+		}
+	}
+	return name
+}
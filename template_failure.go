@@ -0,0 +1,77 @@
+package celjsontemplates
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// TemplateFailure is returned by Expand when a template calls fail or fail_if.
+// It stops the expansion whatever the error handling options are.
+type TemplateFailure struct {
+	// Message is the message passed to fail
+	Message string
+	// Path is the JSON path of the output value that was being expanded, e.g. $.items[0].price
+	Path string
+	// Detail holds the optional detail value passed to fail, or nil
+	Detail any
+}
+
+func (e *TemplateFailure) Error() string {
+	return fmt.Sprintf("template failure at %s: %s", e.Path, e.Message)
+}
+
+// newTemplateFailure builds the CEL error value that carries a TemplateFailure
+func newTemplateFailure(ex *expansion, message ref.Val, detail ref.Val) ref.Val {
+	failure := &TemplateFailure{
+		Message: fmt.Sprint(message.Value()),
+		Path:    ex.currentPath(),
+	}
+	if detail != nil {
+		failure.Detail = outputValue(detail)
+	}
+	return types.WrapErr(failure)
+}
+
+// getFailFunctions provides fail and fail_if, which stop the expansion with a TemplateFailure.
+// fail_if removes the property when the condition is false, unless a value is given to use instead.
+func getFailFunctions() []cel.EnvOption {
+	valueType := cel.TypeParamType("V")
+
+	return []cel.EnvOption{
+		cel.Function("fail",
+			cel.Overload("fail_expansion_string", []*cel.Type{expansionType, cel.StringType}, cel.DynType,
+				cel.FunctionBinding(func(args ...ref.Val) ref.Val {
+					return newTemplateFailure(args[0].(*expansion), args[1], nil)
+				}),
+			),
+			cel.Overload("fail_expansion_string_dyn", []*cel.Type{expansionType, cel.StringType, cel.DynType}, cel.DynType,
+				cel.FunctionBinding(func(args ...ref.Val) ref.Val {
+					return newTemplateFailure(args[0].(*expansion), args[1], args[2])
+				}),
+			),
+		),
+		cel.Function("fail_if",
+			cel.Overload("fail_if_expansion_bool_string", []*cel.Type{expansionType, cel.BoolType, cel.StringType}, cel.DynType,
+				cel.FunctionBinding(func(args ...ref.Val) ref.Val {
+					if args[1] == types.True {
+						return newTemplateFailure(args[0].(*expansion), args[2], nil)
+					}
+					return types.WrapErr(removeAttributeFromOutput)
+				}),
+			),
+			cel.Overload("fail_if_expansion_bool_string_V", []*cel.Type{expansionType, cel.BoolType, cel.StringType, valueType}, valueType,
+				cel.FunctionBinding(func(args ...ref.Val) ref.Val {
+					if args[1] == types.True {
+						return newTemplateFailure(args[0].(*expansion), args[2], nil)
+					}
+					return args[3]
+				}),
+			),
+		),
+		expansionMacro("fail"),
+		expansionMacro("fail_if"),
+	}
+}
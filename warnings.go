@@ -0,0 +1,52 @@
+package celjsontemplates
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// Warning is raised by a template calling warn. The expansion carries on as normal.
+type Warning struct {
+	// Message is the message passed to warn
+	Message string
+	// Path is the JSON path of the output value that was being expanded, e.g. $.items[0].price
+	Path string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Path, w.Message)
+}
+
+// addWarning records a warning against the output value currently being expanded
+func (e *expansion) addWarning(message ref.Val) {
+	e.warnings = append(e.warnings, Warning{
+		Message: fmt.Sprint(message.Value()),
+		Path:    e.currentPath(),
+	})
+}
+
+// getWarnFunction provides warn, which records a warning and returns its value (or null if there isn't one)
+func getWarnFunction() []cel.EnvOption {
+	valueType := cel.TypeParamType("V")
+
+	return []cel.EnvOption{
+		cel.Function("warn",
+			cel.Overload("warn_expansion_string", []*cel.Type{expansionType, cel.StringType}, cel.NullType,
+				cel.FunctionBinding(func(args ...ref.Val) ref.Val {
+					args[0].(*expansion).addWarning(args[1])
+					return types.NullValue
+				}),
+			),
+			cel.Overload("warn_expansion_string_V", []*cel.Type{expansionType, cel.StringType, valueType}, valueType,
+				cel.FunctionBinding(func(args ...ref.Val) ref.Val {
+					args[0].(*expansion).addWarning(args[1])
+					return args[2]
+				}),
+			),
+		),
+		expansionMacro("warn"),
+	}
+}
@@ -0,0 +1,231 @@
+package celjsontemplates
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	orderedmap "github.com/wk8/go-ordered-map/v2"
+)
+
+const (
+	// xmlAttributePrefix marks an output key as an attribute of the enclosing element
+	xmlAttributePrefix = "@"
+	// xmlTextKey holds the text content of the enclosing element
+	xmlTextKey = "#text"
+	// defaultXmlRootElement is used when the output doesn't have a single top level element
+	defaultXmlRootElement = "root"
+)
+
+// XmlEncoder encodes the template output as XML.
+//
+// Output keys are mapped to elements using the following conventions:
+//   - keys starting with "@" become attributes of the enclosing element (including "@xmlns" and "@xmlns:prefix" namespace declarations)
+//   - the "#text" key becomes the text content of the enclosing element
+//   - lists produce one element per item, each named after the key
+//   - element names may use namespace prefixes, e.g. "soap:Body"
+//
+// If the output has a single top level key that isn't a list that key is used as the document element,
+// otherwise the output is wrapped in RootElement (or "root" if that is empty).
+type XmlEncoder struct {
+	// RootElement names the document element when the output doesn't have a single top level element
+	RootElement string
+	// Indent is used to indent nested elements. No indentation is applied when empty.
+	Indent string
+}
+
+// Encode implements Encoder
+func (e XmlEncoder) Encode(value any) ([]byte, error) {
+	nv, err := normalizeOutput(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+
+	// A list would repeat the element, giving more than one document element
+	root, ok := nv.(*orderedmap.OrderedMap[string, any])
+	if ok && root.Len() == 1 && isXmlElementKey(root.Oldest().Key) && !isXmlList(root.Oldest().Value) {
+		err = e.writeElement(&buf, root.Oldest().Key, root.Oldest().Value, 0)
+	} else {
+		rootName := e.RootElement
+		if rootName == "" {
+			rootName = defaultXmlRootElement
+		}
+		err = e.writeElement(&buf, rootName, nv, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if e.Indent != "" {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+func isXmlList(value any) bool {
+	_, ok := value.([]any)
+	return ok
+}
+
+// writeElement writes the element called name, repeating it for each item if value is a list
+func (e XmlEncoder) writeElement(buf *bytes.Buffer, name string, value any, depth int) error {
+	if !isValidXmlName(name) {
+		return fmt.Errorf("xml: invalid element name %q", name)
+	}
+
+	if items, ok := value.([]any); ok {
+		for i, item := range items {
+			if i > 0 {
+				e.writeIndent(buf, depth)
+			}
+			err := e.writeElement(buf, name, item, depth)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	buf.WriteString("<" + name)
+
+	obj, isObject := value.(*orderedmap.OrderedMap[string, any])
+	if !isObject {
+		if value == nil {
+			buf.WriteString("/>")
+			return nil
+		}
+		buf.WriteString(">")
+		err := writeXmlText(buf, value)
+		if err != nil {
+			return err
+		}
+		buf.WriteString("</" + name + ">")
+		return nil
+	}
+
+	// Attributes first
+	for pair := obj.Oldest(); pair != nil; pair = pair.Next() {
+		if !strings.HasPrefix(pair.Key, xmlAttributePrefix) {
+			continue
+		}
+		attrName := strings.TrimPrefix(pair.Key, xmlAttributePrefix)
+		if !isValidXmlName(attrName) {
+			return fmt.Errorf("xml: invalid attribute name %q", attrName)
+		}
+		if pair.Value == nil {
+			continue
+		}
+		buf.WriteString(" " + attrName + `="`)
+		err := writeXmlText(buf, pair.Value)
+		if err != nil {
+			return fmt.Errorf("xml: attribute %q: %w", attrName, err)
+		}
+		buf.WriteString(`"`)
+	}
+
+	text, hasText := obj.Get(xmlTextKey)
+	hasChildren := false
+	for pair := obj.Oldest(); pair != nil; pair = pair.Next() {
+		if isXmlElementKey(pair.Key) {
+			hasChildren = true
+			break
+		}
+	}
+
+	if !hasChildren && (!hasText || text == nil) {
+		buf.WriteString("/>")
+		return nil
+	}
+	buf.WriteString(">")
+
+	if hasText && text != nil {
+		err := writeXmlText(buf, text)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only indent children when there's no text content to preserve
+	indentChildren := !hasText || text == nil
+	for pair := obj.Oldest(); pair != nil; pair = pair.Next() {
+		if !isXmlElementKey(pair.Key) {
+			continue
+		}
+		if indentChildren {
+			e.writeIndent(buf, depth+1)
+		}
+		err := e.writeElement(buf, pair.Key, pair.Value, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	if indentChildren {
+		e.writeIndent(buf, depth)
+	}
+
+	buf.WriteString("</" + name + ">")
+	return nil
+}
+
+func (e XmlEncoder) writeIndent(buf *bytes.Buffer, depth int) {
+	if e.Indent == "" {
+		return
+	}
+	buf.WriteByte('\n')
+	buf.WriteString(strings.Repeat(e.Indent, depth))
+}
+
+// writeXmlText writes a scalar value as escaped character data
+func writeXmlText(buf *bytes.Buffer, value any) error {
+	var text string
+	switch val := value.(type) {
+	case string:
+		text = val
+	case bool:
+		text = strconv.FormatBool(val)
+	case int64:
+		text = strconv.FormatInt(val, 10)
+	case uint64:
+		text = strconv.FormatUint(val, 10)
+	case float64:
+		text = strconv.FormatFloat(val, 'f', -1, 64)
+	case []byte:
+		text = base64.StdEncoding.EncodeToString(val)
+	case time.Time:
+		text = val.Format(time.RFC3339Nano)
+	case time.Duration:
+		text = val.String()
+	default:
+		return fmt.Errorf("xml: unable to write %T as text", value)
+	}
+	return xml.EscapeText(buf, []byte(text))
+}
+
+// isXmlElementKey reports whether an output key produces a child element
+func isXmlElementKey(key string) bool {
+	return key != xmlTextKey && !strings.HasPrefix(key, xmlAttributePrefix)
+}
+
+// isValidXmlName checks a (possibly prefixed) element or attribute name
+func isValidXmlName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if unicode.IsLetter(r) || r == '_' || r == ':' {
+			continue
+		}
+		if i > 0 && (unicode.IsDigit(r) || r == '-' || r == '.') {
+			continue
+		}
+		return false
+	}
+	return true
+}